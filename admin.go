@@ -0,0 +1,762 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// admin serves the HTTP admin API used to inspect and modify the hosts data stored in etcd.
+type admin struct {
+	h    *EtcdHosts
+	addr string
+
+	sync.Mutex
+	srv    *http.Server
+	shifts map[string]*weightShift
+}
+
+// adminRecord is the JSON representation of a host name and its addresses.
+type adminRecord struct {
+	Host string            `json:"host"`
+	IPs  []string          `json:"ips"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+func newAdmin(h *EtcdHosts, addr string) *admin {
+	return &admin{h: h, addr: addr, shifts: make(map[string]*weightShift)}
+}
+
+// OnStartup starts the admin http server.
+func (a *admin) OnStartup() error {
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	if a.h.adminAuth.tlsConfig != nil {
+		ln = tls.NewListener(ln, a.h.adminAuth.tlsConfig)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.dashboard)
+	mux.HandleFunc("/reloads", a.reloads)
+	mux.HandleFunc("/records", a.records)
+	mux.HandleFunc("/records/", a.record)
+	mux.HandleFunc("/health", a.health)
+	mux.HandleFunc("/reload", a.reload)
+	mux.HandleFunc("/validate", a.validate)
+	mux.HandleFunc("/zones", a.zones)
+	mux.HandleFunc("/zones/", a.zone)
+	mux.HandleFunc("/import", a.importZone)
+	mux.HandleFunc("/hosts", a.bulk)
+	mux.HandleFunc("/debug_queries", a.debugQueries)
+	mux.HandleFunc("/diff", a.diff)
+	mux.HandleFunc("/watch", a.watch)
+	mux.HandleFunc("/backups", a.listBackups)
+	mux.HandleFunc("/backups/", a.backup)
+	mux.HandleFunc("/staging", a.staging)
+	mux.HandleFunc("/staging/promote", a.promote)
+	mux.HandleFunc("/shifts", a.listShifts)
+	mux.HandleFunc("/shifts/", a.shift)
+
+	srv := &http.Server{Handler: a.h.adminAuth.handler(mux)}
+	a.Lock()
+	a.srv = srv
+	a.Unlock()
+
+	go func() { _ = srv.Serve(ln) }()
+	log.Infof("etcdhosts admin api listening on %s", a.addr)
+	return nil
+}
+
+// OnShutdown stops the admin http server and cancels the running weight shifts.
+func (a *admin) OnShutdown() error {
+	a.Lock()
+	defer a.Unlock()
+
+	for _, s := range a.shifts {
+		s.cancel()
+	}
+
+	if a.srv == nil {
+		return nil
+	}
+	err := a.srv.Close()
+	a.srv = nil
+	return err
+}
+
+// records lists the records loaded from etcd, ?offset= and ?limit= select a page and the total
+// number of records is returned in the X-Total-Count header.
+func (a *admin) records(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	page := [2]int{0, -1}
+	for i, p := range []string{"offset", "limit"} {
+		v := r.URL.Query().Get(p)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid "+p+": "+v))
+			return
+		}
+		page[i] = n
+	}
+	records, total := a.h.snapshot().hmap.records(page[0], page[1])
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	writeJSON(w, http.StatusOK, records)
+}
+
+// record gets, creates/updates or deletes a single host name.
+func (a *admin) record(w http.ResponseWriter, r *http.Request) {
+	name := plugin.Name(strings.TrimPrefix(r.URL.Path, "/records/")).Normalize()
+	if name == "." {
+		writeError(w, http.StatusBadRequest, errors.New("missing host name"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if rec, ok := a.h.snapshot().hmap.record(name); ok {
+			writeJSON(w, http.StatusOK, rec)
+			return
+		}
+		writeError(w, http.StatusNotFound, errors.New("host not found"))
+	case http.MethodPut:
+		if err := checkHostName(name); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if plugin.Zones(a.h.Origins).Matches(name) == "" {
+			writeError(w, http.StatusBadRequest, errors.New("host is not in the plugin origins"))
+			return
+		}
+		var rec adminRecord
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(rec.IPs) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("ips must not be empty"))
+			return
+		}
+		ips, err := hostAddrs(rec.IPs)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := checkTags(rec.Meta); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		a.save(w, func(hosts []byte) ([]byte, error) {
+			return setTaggedHost(hosts, name, ips, rec.Meta), nil
+		})
+	case http.MethodDelete:
+		a.save(w, func(hosts []byte) ([]byte, error) {
+			return removeHost(hosts, name), nil
+		})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// save writes the updated hosts back to etcd and reports the result.
+func (a *admin) save(w http.ResponseWriter, update func(hosts []byte) ([]byte, error)) {
+	err := a.h.saveEtcdHosts(update)
+	switch {
+	case errors.Is(err, errHostsConflict):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errReadOnly):
+		writeError(w, http.StatusNotImplemented, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// health reports the etcd connectivity and the currently loaded data, etcd is only checked
+// with the etcd backend.
+func (a *admin) health(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), a.h.etcdConfig.Timeout)
+	defer cancel()
+
+	s := a.h.snapshot()
+	status := map[string]interface{}{
+		"revision": s.revision,
+		"entries":  s.inline.Len() + s.hmap.Len(),
+	}
+
+	code := http.StatusOK
+	if a.h.etcdClient != nil {
+		if _, err := a.h.client().Get(ctx, a.h.etcdConfig.HostsKey, clientv3.WithCountOnly()); err != nil {
+			status["etcd"] = err.Error()
+			code = http.StatusServiceUnavailable
+		} else {
+			status["etcd"] = "ok"
+			a.h.touch()
+		}
+	}
+	if a.h.stale() {
+		status["stale"] = true
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, status)
+}
+
+// reload asks the plugin to reload hosts from the storage, with force=true the reload is applied
+// even if it removes more than max_change_ratio of the records.
+func (a *admin) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	a.h.triggerReload(r.URL.Query().Get("force") == "true")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validate checks the hosts in the storage (GET) or the hosts sent in the request body (POST).
+func (a *admin) validate(w http.ResponseWriter, r *http.Request) {
+	var hosts []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		ctx, cancel := context.WithTimeout(r.Context(), a.h.etcdConfig.Timeout)
+		defer cancel()
+		hosts, _, err = a.h.storage.load(ctx)
+	case http.MethodPost:
+		hosts, err = io.ReadAll(r.Body)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	findings := a.h.validateHosts(hosts)
+	if len(findings) == 0 {
+		writeJSON(w, http.StatusOK, map[string][]finding{"findings": {}})
+		return
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, map[string][]finding{"findings": findings})
+}
+
+// zones lists the origins the plugin is authoritative for, including the derived reverse zones.
+func (a *admin) zones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.h.zones())
+}
+
+// zone exports the records of a single origin as a zone file.
+func (a *admin) zone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	origin := plugin.Name(strings.TrimPrefix(r.URL.Path, "/zones/")).Normalize()
+
+	var buf bytes.Buffer
+	if err := a.h.exportZone(&buf, origin); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/dns")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// importZone imports the A and AAAA records of a BIND zone file sent in the request body,
+// the zone origin is taken from the origin query parameter unless the file sets $ORIGIN.
+func (a *admin) importZone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	zi, err := a.h.parseZone(r.Body, r.URL.Query().Get("origin"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(zi.ips) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no A or AAAA records in the plugin origins"))
+		return
+	}
+
+	err = a.h.saveEtcdHosts(func(hosts []byte) ([]byte, error) {
+		return importHosts(hosts, zi.ips), nil
+	})
+	switch {
+	case errors.Is(err, errHostsConflict):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errReadOnly):
+		writeError(w, http.StatusNotImplemented, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"imported": len(zi.ips),
+			"skipped":  zi.skipped,
+			"ttls":     append([]string{}, zi.ttls...),
+		})
+	}
+}
+
+// debugQueries gets or sets the fraction of queries that are logged.
+func (a *admin) debugQueries(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Fraction float64 `json:"fraction"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Fraction < 0 || req.Fraction > 1 {
+			writeError(w, http.StatusBadRequest, errors.New("fraction must be between 0 and 1"))
+			return
+		}
+		a.h.setDebugQueries(req.Fraction)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]float64{"fraction": a.h.debugQueriesFraction()})
+}
+
+// diff compares the hosts key at the etcd revisions ?from= and ?to=, to defaults to the current
+// revision.
+func (a *admin) diff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var revs [2]int64
+	for i, p := range []string{"from", "to"} {
+		v := r.URL.Query().Get(p)
+		if v == "" && p == "to" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid "+p+" revision: "+v))
+			return
+		}
+		revs[i] = n
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.h.etcdConfig.Timeout)
+	defer cancel()
+
+	changes, err := a.h.diffRevisions(ctx, revs[0], revs[1])
+	switch {
+	case errors.Is(err, errReadOnly):
+		writeError(w, http.StatusNotImplemented, err)
+	case errors.Is(err, rpctypes.ErrCompacted), errors.Is(err, rpctypes.ErrFutureRev):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"from":    revs[0],
+			"to":      revs[1],
+			"changes": append([]recordChange{}, changes...),
+		})
+	}
+}
+
+// watch streams the record changes of every following reload as JSON lines until the client
+// disconnects.
+func (a *admin) watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	ch := a.h.changes.subscribe()
+	defer a.h.changes.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// listBackups lists the backup snapshots, oldest first.
+func (a *admin) listBackups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if a.h.backups == nil {
+		writeError(w, http.StatusNotFound, errors.New("no backup directory configured"))
+		return
+	}
+	names, err := a.h.backups.list()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, append([]string{}, names...))
+}
+
+// backup gets a backup snapshot (GET /backups/{name}) or restores it (POST /backups/{name}/restore),
+// merged and included keys are only restored with ?all=true.
+func (a *admin) backup(w http.ResponseWriter, r *http.Request) {
+	if a.h.backups == nil {
+		writeError(w, http.StatusNotFound, errors.New("no backup directory configured"))
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/backups/")
+	restore := strings.HasSuffix(name, "/restore")
+	name = strings.TrimSuffix(name, "/restore")
+
+	switch {
+	case r.Method == http.MethodGet && !restore:
+		s, err := a.h.backups.read(name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			writeError(w, http.StatusNotFound, errors.New("backup not found"))
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		default:
+			writeJSON(w, http.StatusOK, s)
+		}
+	case r.Method == http.MethodPost && restore:
+		findings, err := a.h.backups.restore(name, r.URL.Query().Get("all") == "true")
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			writeError(w, http.StatusNotFound, errors.New("backup not found"))
+		case errors.Is(err, errHostsConflict):
+			writeError(w, http.StatusConflict, err)
+		case errors.Is(err, errReadOnly):
+			writeError(w, http.StatusNotImplemented, err)
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+		case len(findings) > 0:
+			writeJSON(w, http.StatusUnprocessableEntity, map[string][]finding{"findings": findings})
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// staging validates the staged hosts and diffs them against the live hosts.
+func (a *admin) staging(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.h.etcdConfig.Timeout)
+	defer cancel()
+
+	review, err := a.h.reviewStaging(ctx)
+	switch {
+	case errors.Is(err, errNoStaging):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, review)
+	}
+}
+
+// promote copies the staged hosts to the live hosts key, ?revision= pins the reviewed revision of
+// the staging key.
+func (a *admin) promote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var revision int64
+	if v := r.URL.Query().Get("revision"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid revision: "+v))
+			return
+		}
+		revision = n
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), a.h.etcdConfig.Timeout)
+	defer cancel()
+
+	rejected, err := a.h.promoteStaging(ctx, revision)
+	switch {
+	case errors.Is(err, errNoStaging):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errHostsConflict), errors.Is(err, errStagingChanged):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	case rejected != nil:
+		writeJSON(w, http.StatusUnprocessableEntity, rejected)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listShifts lists the running weight shifts.
+func (a *admin) listShifts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	a.Lock()
+	shifts := make([]weightShift, 0, len(a.shifts))
+	for _, s := range a.shifts {
+		shifts = append(shifts, s.status())
+	}
+	a.Unlock()
+	sort.Slice(shifts, func(i, j int) bool { return shifts[i].Host < shifts[j].Host })
+	writeJSON(w, http.StatusOK, shifts)
+}
+
+// shift gets, starts or cancels the weight shift of a single host name.
+func (a *admin) shift(w http.ResponseWriter, r *http.Request) {
+	name := shiftName(r.URL.Path)
+	if name == "." {
+		writeError(w, http.StatusBadRequest, errors.New("missing host name"))
+		return
+	}
+
+	a.Lock()
+	running := a.shifts[name]
+	a.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if running == nil {
+			writeError(w, http.StatusNotFound, errors.New("no weight shift running"))
+			return
+		}
+		writeJSON(w, http.StatusOK, running.status())
+	case http.MethodPost:
+		if running != nil {
+			writeError(w, http.StatusConflict, errors.New("a weight shift is already running"))
+			return
+		}
+		var req shiftRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s, interval, err := a.newWeightShift(name, req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		// the first step adds the new address with 0% synchronously so write errors are reported
+		err = a.shiftStep(s, 0)
+		switch {
+		case errors.Is(err, errHostsConflict):
+			writeError(w, http.StatusConflict, err)
+			return
+		case errors.Is(err, errReadOnly):
+			writeError(w, http.StatusNotImplemented, err)
+			return
+		case err != nil:
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		a.Lock()
+		if a.shifts[name] != nil {
+			a.Unlock()
+			writeError(w, http.StatusConflict, errors.New("a weight shift is already running"))
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancel = cancel
+		a.shifts[name] = s
+		a.Unlock()
+
+		go a.runShift(ctx, s, interval)
+		writeJSON(w, http.StatusAccepted, s.status())
+	case http.MethodDelete:
+		if running == nil {
+			writeError(w, http.StatusNotFound, errors.New("no weight shift running"))
+			return
+		}
+		running.cancel()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// removeHost removes name from every hosts line and drops its ALIAS lines, lines left without
+// any host name are dropped.
+func removeHost(hosts []byte, name string) []byte {
+	remove := func(n string) bool { return n == name }
+	return removeAliases(removeHosts(hosts, remove), remove)
+}
+
+// removeAliases drops the ALIAS lines of the names remove reports.
+func removeAliases(hosts []byte, remove func(name string) bool) []byte {
+	var buf bytes.Buffer
+	for _, line := range hostsLines(hosts) {
+		content := line
+		if i := bytes.IndexByte(line, '#'); i >= 0 {
+			content = line[:i]
+		}
+		f := bytes.Fields(content)
+		if len(f) == 3 && bytes.EqualFold(f[0], []byte(aliasKeyword)) && remove(plugin.Name(string(f[1])).Normalize()) {
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// removeHosts removes the names remove reports from every hosts line, lines left without any
+// host name are dropped.
+func removeHosts(hosts []byte, remove func(name string) bool) []byte {
+	return removeAddrHosts(hosts, func(_ netip.Addr, name string) bool { return remove(name) })
+}
+
+// removeAddrHosts is like removeHosts, remove also gets the address of the line.
+func removeAddrHosts(hosts []byte, remove func(addr netip.Addr, name string) bool) []byte {
+	var buf bytes.Buffer
+	for _, b := range hostsLines(hosts) {
+		line := string(b)
+		content, comment := line, ""
+		if i := strings.Index(line, "#"); i >= 0 {
+			content, comment = line[:i], line[i:]
+		}
+
+		f := strings.Fields(content)
+		var addr netip.Addr
+		if len(f) >= 2 {
+			addr, _ = parseAddr(f[0])
+		}
+		if !addr.IsValid() {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+			continue
+		}
+
+		kept := []string{f[0]}
+		for _, n := range f[1:] {
+			if !remove(addr, plugin.Name(n).Normalize()) {
+				kept = append(kept, n)
+			}
+		}
+		switch {
+		case len(kept) == len(f):
+			buf.WriteString(line)
+		case len(kept) == 1:
+			continue
+		default:
+			buf.WriteString(strings.Join(kept, " "))
+			if comment != "" {
+				buf.WriteString(" " + comment)
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// setHost replaces all addresses of name with ips.
+func setHost(hosts []byte, name string, ips []string) []byte {
+	return setTaggedHost(hosts, name, ips, nil)
+}
+
+// setTaggedHost is like setHost, the lines of name carry tags in their comment.
+func setTaggedHost(hosts []byte, name string, ips []string, tags map[string]string) []byte {
+	buf := bytes.NewBuffer(removeHost(hosts, name))
+	writeTaggedHost(buf, name, ips, tags)
+	return buf.Bytes()
+}
+
+// checkHostName returns an error unless name is a domain name that can be written to a hosts line.
+func checkHostName(name string) error {
+	if _, ok := dns.IsDomainName(name); !ok || strings.IndexFunc(name, unsafeHostsRune) >= 0 {
+		return fmt.Errorf("invalid host name %q", name)
+	}
+	return nil
+}
+
+// hostAddrs returns ips in the form they are written to hosts lines, addresses with a zone are
+// rejected.
+func hostAddrs(ips []string) ([]string, error) {
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("invalid ip %q", ip)
+		}
+		addrs[i] = addr.String()
+	}
+	return addrs, nil
+}
+
+// writeTaggedHost writes a hosts line with tags for every address of name.
+func writeTaggedHost(buf *bytes.Buffer, name string, ips []string, tags map[string]string) {
+	comment := ""
+	if len(tags) > 0 {
+		comment = " # " + formatTags(tags)
+	}
+	for _, ip := range ips {
+		buf.WriteString(ip + " " + strings.TrimSuffix(name, ".") + comment + "\n")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,126 @@
+package etcdhosts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckHostName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"www.example.org.", true},
+		{"_srv.example.org.", true},
+		{"www.example.org.\n10.6.6.6 evil.example.org.", false},
+		{"www example.org.", false},
+		{"www.example.org.#x", false},
+		{"www.\texample.org.", false},
+		{"www.\x00example.org.", false},
+		{"www..example.org.", false},
+		{strings.Repeat("a", 64) + ".example.org.", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkHostName(tt.name); (err == nil) != tt.valid {
+			t.Errorf("checkHostName(%q) = %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestHostAddrs(t *testing.T) {
+	tests := []struct {
+		ips  []string
+		want []string
+	}{
+		{[]string{"10.0.0.1", "::1"}, []string{"10.0.0.1", "::1"}},
+		{[]string{"2001:DB8:0:0::1"}, []string{"2001:db8::1"}},
+		{[]string{"::ffff:10.0.0.1"}, []string{"::ffff:10.0.0.1"}},
+		{[]string{"10.0.0.1 evil.example.org"}, nil},
+		{[]string{"10.0.0.1\n10.6.6.6"}, nil},
+		{[]string{"fe80::1%eth0"}, nil},
+		{[]string{"10.0.0.1", "010.0.0.1"}, nil},
+		{[]string{""}, nil},
+	}
+
+	for _, tt := range tests {
+		got, err := hostAddrs(tt.ips)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("hostAddrs(%q) = %q, want error", tt.ips, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("hostAddrs(%q) = %q, %v, want %q", tt.ips, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckTags(t *testing.T) {
+	tests := []struct {
+		tags  map[string]string
+		valid bool
+	}{
+		{nil, true},
+		{map[string]string{"owner": "team-a", "ticket": "OPS-1"}, true},
+		{map[string]string{"": "team-a"}, false},
+		{map[string]string{"own=er": "team-a"}, false},
+		{map[string]string{"owner": "team a"}, false},
+		{map[string]string{"owner": "team-a\n10.6.6.6 evil.example.org"}, false},
+		{map[string]string{"owner": "team#a"}, false},
+		{map[string]string{"own\ter": "team-a"}, false},
+	}
+
+	for _, tt := range tests {
+		if err := checkTags(tt.tags); (err == nil) != tt.valid {
+			t.Errorf("checkTags(%q) = %v, want valid %t", tt.tags, err, tt.valid)
+		}
+	}
+}
+
+// TestPutRecordInvalid checks that PUT /records rejects input that would write broken or
+// additional hosts lines before it touches the storage.
+func TestPutRecordInvalid(t *testing.T) {
+	h := &EtcdHosts{HostsFile: newHostsFile()}
+	h.Origins = []string{"example.org."}
+	a := newAdmin(h, "")
+
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"newline in name", "/records/www.example.org%0A10.6.6.6%20evil.example.org", `{"ips": ["10.0.0.1"]}`},
+		{"comment in name", "/records/www%23.example.org", `{"ips": ["10.0.0.1"]}`},
+		{"outside origins", "/records/www.example.net", `{"ips": ["10.0.0.1"]}`},
+		{"newline in ip", "/records/www.example.org", `{"ips": ["10.0.0.1\n10.6.6.6 evil.example.org"]}`},
+		{"space in ip", "/records/www.example.org", `{"ips": ["10.0.0.1 evil.example.org"]}`},
+		{"ip zone", "/records/www.example.org", `{"ips": ["fe80::1%eth0"]}`},
+		{"no ips", "/records/www.example.org", `{"ips": []}`},
+		{"newline in tag", "/records/www.example.org", `{"ips": ["10.0.0.1"], "meta": {"owner": "a\n10.6.6.6 evil.example.org"}}`},
+		{"invalid json", "/records/www.example.org", `{"ips": `},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			a.record(w, httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+		})
+	}
+}
+
+func TestSetTaggedHost(t *testing.T) {
+	hosts := "10.0.0.1 www.example.org\nALIAS www.example.org lb.example.net\n10.0.0.2 api.example.org\n"
+	got := setTaggedHost([]byte(hosts), "www.example.org.", []string{"10.0.0.3", "::1"}, map[string]string{"owner": "team-a"})
+	want := "10.0.0.2 api.example.org\n10.0.0.3 www.example.org # owner=team-a\n::1 www.example.org # owner=team-a\n"
+	if string(got) != want {
+		t.Errorf("hosts = %q, want %q", got, want)
+	}
+}
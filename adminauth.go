@@ -0,0 +1,138 @@
+package etcdhosts
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// adminRead allows the requests that don't modify any data
+	adminRead = "read"
+	// adminWrite allows all requests
+	adminWrite = "write"
+)
+
+// adminAuth authenticates the admin API clients with bearer tokens and client certificates and
+// authorizes them by role, GET and HEAD requests need the read role and all other requests the
+// write role. Without tokens and client certificates every request is allowed.
+type adminAuth struct {
+	// tokens maps the bearer tokens to their roles
+	tokens map[string]string
+	// clients maps the common names of client certificates to their roles
+	clients map[string]string
+
+	// tlsConfig serves the admin API over TLS, nil serves plain HTTP
+	tlsConfig *tls.Config
+}
+
+// adminReadOnlyPosts are the POST endpoints that don't modify any data.
+var adminReadOnlyPosts = map[string]bool{"/validate": true}
+
+// adminPublicPaths are served without authentication, the dashboard page holds no data and asks
+// for a token to read it.
+var adminPublicPaths = map[string]bool{"/": true}
+
+// parseRole parses the role and values of an `admin_token ROLE TOKEN...` or
+// `admin_client ROLE COMMON_NAME...` property into roles.
+func parseRole(args []string, roles map[string]string) (map[string]string, error) {
+	if len(args) < 2 {
+		return roles, errors.New("needs a role (read or write) and at least one value")
+	}
+	if args[0] != adminRead && args[0] != adminWrite {
+		return roles, fmt.Errorf("unknown role '%s'", args[0])
+	}
+	if roles == nil {
+		roles = make(map[string]string)
+	}
+	for _, v := range args[1:] {
+		roles[v] = args[0]
+	}
+	return roles, nil
+}
+
+// parseTLS parses an `admin_tls CERT KEY [CLIENT_CA]` property, with a client CA every client must
+// present a certificate signed by it.
+func (a *adminAuth) parseTLS(args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New("admin_tls needs a certificate, a key and an optional client CA")
+	}
+	cert, err := tls.LoadX509KeyPair(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	a.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(args) == 3 {
+		pem, err := os.ReadFile(args[2])
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", args[2])
+		}
+		a.tlsConfig.ClientCAs = pool
+		a.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// verifiesClients reports whether clients must present a certificate signed by the client CA.
+func (a *adminAuth) verifiesClients() bool {
+	return a.tlsConfig != nil && a.tlsConfig.ClientCAs != nil
+}
+
+// role returns the role of the client of r, empty if it is not authenticated. A verified client
+// certificate has the write role unless admin_client maps common names to roles.
+func (a *adminAuth) role(r *http.Request) string {
+	if a.tokens == nil && !a.verifiesClients() {
+		return adminWrite
+	}
+
+	role := ""
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for t, tokenRole := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				role = tokenRole
+			}
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && role != adminWrite {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		switch {
+		case a.clients == nil:
+			role = adminWrite
+		case a.clients[cn] != "":
+			role = a.clients[cn]
+		}
+	}
+	return role
+}
+
+// handler wraps next with the authentication and authorization of the admin API.
+func (a *adminAuth) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && adminPublicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		role := a.role(r)
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="etcdhosts"`)
+			writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead ||
+			r.Method == http.MethodPost && adminReadOnlyPosts[r.URL.Path]
+		if !readOnly && role != adminWrite {
+			writeError(w, http.StatusForbidden, errors.New("the write role is required"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
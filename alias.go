@@ -0,0 +1,122 @@
+package etcdhosts
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// aliasKeyword starts an `ALIAS NAME TARGET` hosts line
+	aliasKeyword = "ALIAS"
+	// aliasMaxDepth is the maximum number of ALIAS entries followed in the store
+	aliasMaxDepth = 8
+	// aliasNegativeTTL is how long an upstream lookup without addresses is cached
+	aliasNegativeTTL = 30 * time.Second
+)
+
+type aliasCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type aliasCacheEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// aliasCache caches the addresses of ALIAS targets resolved through the upstream for the
+// lowest TTL of the answer.
+type aliasCache struct {
+	sync.Mutex
+	entries map[aliasCacheKey]aliasCacheEntry
+}
+
+func newAliasCache() *aliasCache {
+	return &aliasCache{entries: make(map[aliasCacheKey]aliasCacheEntry)}
+}
+
+// lookupAlias flattens the ALIAS entry of name into the qtype addresses of its target, targets
+// in the store are resolved directly and all other targets through the upstream.
+func (h *EtcdHosts) lookupAlias(ctx context.Context, state request.Request, name string, qtype uint16) []net.IP {
+	target := h.LookupStaticAlias(name)
+	if target == "" {
+		return nil
+	}
+
+	for i := 0; i < aliasMaxDepth; i++ {
+		var ips []net.IP
+		if qtype == dns.TypeA {
+			ips = h.LookupStaticHostV4(target)
+		} else {
+			ips = h.LookupStaticHostV6(target)
+		}
+		if len(ips) > 0 {
+			return ips
+		}
+		next := h.LookupStaticAlias(target)
+		if next == "" {
+			break
+		}
+		target = next
+	}
+
+	return h.resolveAlias(ctx, state, target, qtype)
+}
+
+// resolveAlias returns the qtype addresses of target resolved through the upstream.
+func (h *EtcdHosts) resolveAlias(ctx context.Context, state request.Request, target string, qtype uint16) []net.IP {
+	key := aliasCacheKey{name: target, qtype: qtype}
+	h.aliases.Lock()
+	e, ok := h.aliases.entries[key]
+	h.aliases.Unlock()
+	if ok && time.Now().Before(e.expire) {
+		// answers are sorted in place, never hand out the cached slice
+		return append([]net.IP(nil), e.ips...)
+	}
+
+	m, err := h.upstream.Lookup(ctx, state, target, qtype)
+	if err != nil {
+		log.Warningf("failed to resolve alias target [%s]: %s", target, err)
+		return nil
+	}
+
+	var ips []net.IP
+	ttl := aliasNegativeTTL
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		default:
+			continue
+		}
+		// the TTL of the first address replaces the negative TTL, the answer may start with CNAMEs
+		if t := time.Duration(rr.Header().Ttl) * time.Second; len(ips) == 1 || t < ttl {
+			ttl = t
+		}
+	}
+
+	h.aliases.Lock()
+	h.aliases.entries[key] = aliasCacheEntry{ips: ips, expire: time.Now().Add(ttl)}
+	h.aliases.Unlock()
+	return append([]net.IP(nil), ips...)
+}
+
+// LookupStaticAlias returns the target of the ALIAS entry of host, empty if there is none.
+func (h *HostsFile) LookupStaticAlias(host string) string {
+	host = plugin.Name(host).Normalize()
+
+	s := h.snapshot()
+	if target, ok := s.hmap.alias[host]; ok {
+		return target
+	}
+	return s.inline.alias[host]
+}
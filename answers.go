@@ -0,0 +1,64 @@
+package etcdhosts
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// answerKey identifies the cached records of a name.
+type answerKey struct {
+	name  string
+	qtype uint16
+}
+
+// answerCache holds the A and AAAA records built for the names of a snapshot, it is dropped
+// together with the snapshot on every update. Only names found in the hosts are cached, so the
+// cache never grows beyond the loaded hosts.
+type answerCache struct {
+	sync.Map
+}
+
+// addrAnswers returns the A or AAAA records of qname, the cached records are shared between
+// queries and must not be modified.
+func (h *EtcdHosts) addrAnswers(ctx context.Context, state request.Request, qname string, qtype uint16, client net.IP) []dns.RR {
+	// answers sorted or picked per client can't be shared
+	cacheable := h.options.order == "" && !h.hasCanary(qname)
+
+	s := h.snapshot()
+	key := answerKey{name: qname, qtype: qtype}
+	if cacheable {
+		if rrs, ok := s.answers.Load(key); ok {
+			return rrs.([]dns.RR)
+		}
+	}
+
+	var ips []net.IP
+	if qtype == dns.TypeA {
+		ips = h.LookupStaticHostV4(qname)
+	} else {
+		ips = h.LookupStaticHostV6(qname)
+	}
+	if len(ips) == 0 {
+		// aliases resolved through the upstream have their own cache
+		ips = h.lookupAlias(ctx, state, qname, qtype)
+		cacheable = false
+	}
+	ips = h.canaryAnswers(qname, ips, client)
+	h.sortAnswer(ips, client)
+
+	var rrs []dns.RR
+	if qtype == dns.TypeA {
+		rrs = a(qname, h.options.ttlFor(qname), ips)
+	} else {
+		rrs = aaaa(qname, h.options.ttlFor(qname), ips)
+	}
+	if cacheable {
+		s.answers.Store(key, rrs)
+	}
+	return rrs
+}
@@ -0,0 +1,82 @@
+package etcdhosts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// auditEntry is a single record of the audit trail, written as one JSON line per reload.
+type auditEntry struct {
+	Time        time.Time      `json:"time"`
+	Key         string         `json:"key"`
+	OldRevision int64          `json:"old_revision"`
+	Revision    int64          `json:"revision"`
+	Changes     []recordChange `json:"changes"`
+}
+
+// audit writes entry to the audit log file and the etcd audit prefix if they are configured.
+func (h *EtcdHosts) audit(entry auditEntry) {
+	if h.auditLog == "" && h.auditPrefix == "" {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("failed to encode audit entry: %s", err)
+		return
+	}
+
+	if h.auditLog != "" {
+		if err := appendAuditLog(h.auditLog, data); err != nil {
+			log.Errorf("failed to write audit log [%s]: %s", h.auditLog, err)
+		}
+	}
+
+	if h.auditPrefix != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), h.etcdConfig.Timeout)
+		defer cancel()
+
+		// zero padded revisions keep the audit keys sorted in etcd
+		key := fmt.Sprintf("%s%020d", h.auditPrefix, entry.Revision)
+		if err := h.putAudit(ctx, key, data); err != nil {
+			log.Errorf("failed to write etcd audit key [%s]: %s", key, err)
+		}
+	}
+}
+
+// putAudit writes the audit entry data to key unless it exists, every instance loading the same
+// revision records the same change and only the first entry is kept. The key expires after the
+// audit retention.
+func (h *EtcdHosts) putAudit(ctx context.Context, key string, data []byte) error {
+	var opts []clientv3.OpOption
+	if h.auditRetention > 0 {
+		lease, err := h.client().Grant(ctx, int64(h.auditRetention/time.Second))
+		if err != nil {
+			return err
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+	_, err := h.client().Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(data), opts...)).
+		Commit()
+	return err
+}
+
+// appendAuditLog appends a JSON line to the audit log file, creating it if necessary.
+func appendAuditLog(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
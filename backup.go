@@ -0,0 +1,271 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The backup interval and the number of kept snapshots if backup only sets the directory.
+const (
+	defaultBackupInterval = time.Hour
+	defaultBackupKeep     = 24
+)
+
+// backupPattern matches the snapshot files written by backups
+const backupPattern = "hosts-*.json"
+
+// backups periodically snapshots the hosts data to a local directory, a snapshot is only written
+// if the data changed and the oldest snapshots beyond keep are removed.
+type backups struct {
+	h        *EtcdHosts
+	dir      string
+	interval time.Duration
+	keep     int
+	cancel   context.CancelFunc
+
+	// digest is the digest of the last snapshot
+	digest uint64
+}
+
+// backupSnapshot is the JSON content of a snapshot file.
+type backupSnapshot struct {
+	Key      string    `json:"key"`
+	Revision int64     `json:"revision"`
+	Time     time.Time `json:"time"`
+	// Hosts is the hosts data of storages without keys and of snapshots written before the keys
+	// were kept
+	Hosts string `json:"hosts,omitempty"`
+	// Keys are the stored values of the keys of a keyStorage
+	Keys []storedKey `json:"keys,omitempty"`
+}
+
+// digest identifies the data of s, snapshots with the same digest hold the same data.
+func (s *backupSnapshot) digest() uint64 {
+	if s.Keys == nil {
+		return hostsDigest([]byte(s.Hosts))
+	}
+	var buf bytes.Buffer
+	for _, k := range s.Keys {
+		buf.WriteString(k.Key)
+		buf.WriteByte(0)
+		buf.Write(k.Value)
+		buf.WriteByte(0)
+	}
+	return hostsDigest(buf.Bytes())
+}
+
+func newBackups(h *EtcdHosts, dir string, interval time.Duration, keep int) *backups {
+	return &backups{h: h, dir: dir, interval: interval, keep: keep}
+}
+
+// OnStartup starts the periodic snapshots.
+func (b *backups) OnStartup() error {
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go func() {
+		tick := time.NewTicker(b.interval)
+		defer tick.Stop()
+		for {
+			if err := b.snapshot(ctx); err != nil {
+				log.Errorf("failed to back up hosts [%s] to %s: %s", b.h.storage, b.dir, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// OnShutdown stops the periodic snapshots.
+func (b *backups) OnShutdown() error {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return nil
+}
+
+// snapshot writes the hosts data to a new snapshot file if it changed, the snapshot of a
+// keyStorage holds the stored value of every key.
+func (b *backups) snapshot(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, b.h.etcdConfig.Timeout)
+	defer cancel()
+	s := backupSnapshot{Key: b.h.storage.String()}
+	var err error
+	if ks, ok := b.h.storage.(keyStorage); ok {
+		s.Keys, s.Revision, err = ks.loadKeys(ctx)
+	} else {
+		var data []byte
+		data, s.Revision, err = b.h.storage.load(ctx)
+		s.Hosts = string(data)
+	}
+	if err != nil {
+		return err
+	}
+	digest := s.digest()
+	if s.Revision == 0 || digest == b.digest {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	s.Time = now
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("hosts-%s-%d.json", now.Format("20060102T150405Z"), s.Revision)
+	tmp := filepath.Join(b.dir, "."+name)
+	if err := os.WriteFile(tmp, buf, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(b.dir, name)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	b.digest = digest
+	log.Infof("backed up hosts revision %d to %s", s.Revision, name)
+	return b.prune()
+}
+
+// prune removes the oldest snapshots beyond keep.
+func (b *backups) prune() error {
+	names, err := b.list()
+	if err != nil {
+		return err
+	}
+	for len(names) > b.keep {
+		if err := os.Remove(filepath.Join(b.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// list returns the snapshot file names, oldest first.
+func (b *backups) list() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(b.dir, backupPattern))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(paths))
+	for i, p := range paths {
+		names[i] = filepath.Base(p)
+	}
+	// the names start with the UTC time, so they sort in time order
+	sort.Strings(names)
+	return names, nil
+}
+
+// parseBackup parses the `backup DIR [INTERVAL] [KEEP]` arguments.
+func parseBackup(args []string) (dir string, interval time.Duration, keep int, err error) {
+	if len(args) == 0 || len(args) > 3 {
+		return "", 0, 0, fmt.Errorf("backup needs DIR [INTERVAL] [KEEP]")
+	}
+	dir, interval, keep = args[0], defaultBackupInterval, defaultBackupKeep
+	if len(args) > 1 {
+		if interval, err = time.ParseDuration(args[1]); err != nil || interval <= 0 {
+			return "", 0, 0, fmt.Errorf("invalid backup interval '%s'", args[1])
+		}
+	}
+	if len(args) > 2 {
+		if keep, err = strconv.Atoi(args[2]); err != nil || keep <= 0 {
+			return "", 0, 0, fmt.Errorf("invalid number of kept backups '%s'", args[2])
+		}
+	}
+	return dir, interval, keep, nil
+}
+
+// read returns the snapshot stored in the file name.
+func (b *backups) read(name string) (*backupSnapshot, error) {
+	if ok, _ := filepath.Match(backupPattern, name); !ok || filepath.Base(name) != name {
+		return nil, os.ErrNotExist
+	}
+	buf, err := os.ReadFile(filepath.Join(b.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var s backupSnapshot
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, fmt.Errorf("invalid backup %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+// hosts returns the hosts data of the snapshot s.
+func (b *backups) hosts(s *backupSnapshot) ([]byte, error) {
+	if s.Keys == nil {
+		return []byte(s.Hosts), nil
+	}
+	ks, ok := b.h.storage.(keyStorage)
+	if !ok {
+		return nil, fmt.Errorf("backup of [%s] holds keys the backend does not store", s.Key)
+	}
+	return ks.assembleKeys(s.Keys)
+}
+
+// loadLatest serves the hosts of the newest snapshot, it is used when a force_start instance
+// can't load the hosts at startup.
+func (b *backups) loadLatest() {
+	names, err := b.list()
+	if err != nil || len(names) == 0 {
+		return
+	}
+	name := names[len(names)-1]
+	s, err := b.read(name)
+	if err != nil {
+		log.Errorf("failed to read backup %s: %s", name, err)
+		return
+	}
+	hosts, err := b.hosts(s)
+	if err != nil {
+		log.Errorf("failed to read backup %s: %s", name, err)
+		return
+	}
+	if _, newMap := b.h.readHosts(hosts, s.Revision, true); newMap != nil {
+		log.Warningf("serving hosts revision %d from backup %s until etcd is reachable", s.Revision, name)
+	}
+}
+
+// restore writes the hosts of the snapshot name back to etcd with compare-and-swap, snapshots
+// with findings are not restored and their findings are returned instead. Snapshots of a
+// keyStorage restore the hosts key with its stored value, or every key if all is set.
+func (b *backups) restore(name string, all bool) ([]finding, error) {
+	s, err := b.read(name)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := b.hosts(s)
+	if err != nil {
+		return nil, err
+	}
+	if findings := b.h.validateHosts(hosts); len(findings) > 0 {
+		return findings, nil
+	}
+	if s.Keys != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), b.h.etcdConfig.Timeout)
+		defer cancel()
+		// hosts only assembles if the backend stores keys
+		err = b.h.storage.(keyStorage).restoreKeys(ctx, s.Keys, all)
+	} else {
+		err = b.h.saveEtcdHosts(func([]byte) ([]byte, error) {
+			return hosts, nil
+		})
+	}
+	if err == nil {
+		log.Infof("restored hosts revision %d from backup %s", s.Revision, name)
+	}
+	return nil, err
+}
@@ -0,0 +1,175 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/coredns/coredns/plugin"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// errRevisionChanged is returned by a bulk import if the hosts key is not at the expected revision
+var errRevisionChanged = errors.New("hosts key was modified since the expected revision")
+
+// errUnsigned is returned by a bulk import with a signature if signatures are not verified
+var errUnsigned = errors.New("hosts data is not signed, verify is not configured")
+
+// bulkReview is the result of validating imported hosts and comparing them to the live hosts, the
+// revision is the mod revision of the live hosts key the changes are computed against.
+type bulkReview struct {
+	Revision int64          `json:"revision"`
+	Findings []finding      `json:"findings"`
+	Changes  []recordChange `json:"changes"`
+}
+
+// recordsHosts returns records in the hosts format, the metadata of a record becomes the tags of
+// its lines.
+func (h *EtcdHosts) recordsHosts(records []adminRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, rec := range records {
+		name := plugin.Name(rec.Host).Normalize()
+		if err := checkHostName(name); err != nil {
+			return nil, err
+		}
+		if name == "." || plugin.Zones(h.Origins).Matches(name) == "" {
+			return nil, fmt.Errorf("host '%s' is not in the plugin origins", rec.Host)
+		}
+		if len(rec.IPs) == 0 {
+			return nil, fmt.Errorf("ips of host '%s' must not be empty", rec.Host)
+		}
+		ips, err := hostAddrs(rec.IPs)
+		if err != nil {
+			return nil, fmt.Errorf("host '%s': %w", rec.Host, err)
+		}
+		if err := checkTags(rec.Meta); err != nil {
+			return nil, err
+		}
+		writeTaggedHost(&buf, name, ips, rec.Meta)
+	}
+	return buf.Bytes(), nil
+}
+
+// bulkImport replaces the hosts key with hosts, the write only succeeds if the key has not been
+// modified since it was read and, if revision is not 0, if it is still at revision. Hosts with
+// findings are never written, with dryRun the hosts are only validated and compared. If signatures
+// are verified signature must be valid for hosts and is written to the signature key.
+func (h *EtcdHosts) bulkImport(ctx context.Context, hosts, signature []byte, revision int64, dryRun bool) (*bulkReview, error) {
+	if h.etcdClient == nil {
+		return nil, errReadOnly
+	}
+	if h.verifier == nil && len(signature) > 0 {
+		return nil, errUnsigned
+	}
+	resp, err := h.client().Get(ctx, h.etcdConfig.HostsKey)
+	if err != nil {
+		return nil, err
+	}
+	var live []byte
+	var liveRev int64
+	if len(resp.Kvs) == 1 {
+		if live, err = h.cipher.decrypt(h.etcdConfig.HostsKey, resp.Kvs[0].Value); err != nil {
+			return nil, err
+		}
+		liveRev = resp.Kvs[0].ModRevision
+	}
+	if revision != 0 && revision != liveRev {
+		return nil, errRevisionChanged
+	}
+
+	review := &bulkReview{
+		Revision: liveRev,
+		Findings: append([]finding{}, h.validateHosts(hosts)...),
+		Changes:  append([]recordChange{}, diffMaps(h.parse(live), h.parse(hosts))...),
+	}
+	value, err := h.cipher.encrypt(h.etcdConfig.HostsKey, hosts)
+	if err != nil {
+		return nil, err
+	}
+	ops := []clientv3.Op{clientv3.OpPut(h.etcdConfig.HostsKey, string(value))}
+	if h.verifier != nil {
+		if err := h.verifier.verify(hosts, signature); err != nil {
+			review.Findings = append(review.Findings, finding{Message: err.Error()})
+		}
+		ops = append(ops, clientv3.OpPut(h.verifier.signatureKey(h.etcdConfig.HostsKey), string(signature)))
+	}
+	if len(review.Findings) > 0 || dryRun {
+		return review, nil
+	}
+
+	// a missing key has a mod revision of 0, so the compare below also guards creation
+	txnResp, err := h.client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(h.etcdConfig.HostsKey), "=", liveRev)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !txnResp.Succeeded {
+		return nil, errHostsConflict
+	}
+	return review, nil
+}
+
+// bulk replaces the hosts data with the hosts format or JSON records (application/json) sent in
+// the request body, ?revision= requires the hosts key to be at that mod revision and
+// ?dry_run=true only validates and compares the hosts. Signed hosts data needs the signature of
+// the body in the X-Etcdhosts-Signature header.
+func (a *admin) bulk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	var revision int64
+	if v := r.URL.Query().Get("revision"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid revision: "+v))
+			return
+		}
+		revision = n
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	var hosts []byte
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		var records []adminRecord
+		if err = json.NewDecoder(r.Body).Decode(&records); err == nil {
+			hosts, err = a.h.recordsHosts(records)
+		}
+	} else {
+		hosts, err = io.ReadAll(r.Body)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.h.etcdConfig.Timeout)
+	defer cancel()
+
+	signature := []byte(r.Header.Get("X-Etcdhosts-Signature"))
+	review, err := a.h.bulkImport(ctx, hosts, signature, revision, dryRun)
+	switch {
+	case errors.Is(err, errUnsigned):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, errHostsConflict), errors.Is(err, errRevisionChanged):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errReadOnly):
+		writeError(w, http.StatusNotImplemented, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	case len(review.Findings) > 0:
+		writeJSON(w, http.StatusUnprocessableEntity, review)
+	default:
+		writeJSON(w, http.StatusOK, review)
+	}
+}
@@ -0,0 +1,52 @@
+package etcdhosts
+
+import "testing"
+
+func TestRecordsHosts(t *testing.T) {
+	h := &EtcdHosts{HostsFile: newHostsFile()}
+	h.Origins = []string{"example.org."}
+
+	tests := []struct {
+		name    string
+		records []adminRecord
+		want    string
+		valid   bool
+	}{
+		{
+			name: "records",
+			records: []adminRecord{
+				{Host: "www.example.org", IPs: []string{"10.0.0.1", "2001:DB8::1"}, Meta: map[string]string{"owner": "team-a"}},
+				{Host: "API.example.org.", IPs: []string{"10.0.0.2"}},
+			},
+			want:  "10.0.0.1 www.example.org # owner=team-a\n2001:db8::1 www.example.org # owner=team-a\n10.0.0.2 api.example.org\n",
+			valid: true,
+		},
+		{name: "empty", valid: true},
+		{name: "newline in name", records: []adminRecord{{Host: "www.example.org\n10.6.6.6 evil.example.org", IPs: []string{"10.0.0.1"}}}},
+		{name: "comment in name", records: []adminRecord{{Host: "www#.example.org", IPs: []string{"10.0.0.1"}}}},
+		{name: "outside origins", records: []adminRecord{{Host: "www.example.net", IPs: []string{"10.0.0.1"}}}},
+		{name: "root", records: []adminRecord{{Host: ".", IPs: []string{"10.0.0.1"}}}},
+		{name: "no ips", records: []adminRecord{{Host: "www.example.org"}}},
+		{name: "newline in ip", records: []adminRecord{{Host: "www.example.org", IPs: []string{"10.0.0.1\n10.6.6.6 evil.example.org"}}}},
+		{name: "ip zone", records: []adminRecord{{Host: "www.example.org", IPs: []string{"fe80::1%eth0"}}}},
+		{name: "space in tag", records: []adminRecord{{Host: "www.example.org", IPs: []string{"10.0.0.1"}, Meta: map[string]string{"owner": "team a"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.recordsHosts(tt.records)
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("hosts = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("hosts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
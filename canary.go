@@ -0,0 +1,94 @@
+package etcdhosts
+
+import (
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// canaryTag is the tag that marks the addresses of a hosts line as canary, its value is the
+// percentage of clients that get the canary addresses, e.g. `10.0.0.9 www.example.com # canary=10`.
+const canaryTag = "canary"
+
+// canaryKey identifies a canary address of a name.
+type canaryKey struct {
+	name string
+	addr netip.Addr
+}
+
+// lineCanary returns the canary percentage of the comment of a hosts line, ok is false if the
+// line isn't a canary and err is set if the percentage is invalid.
+func lineCanary(comment []byte) (percent uint8, ok bool, err error) {
+	v, found := lineTag(comment, canaryTag)
+	if !found {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseUint(string(v), 10, 8)
+	if err != nil || n > 100 {
+		return 0, false, strconv.ErrRange
+	}
+	return uint8(n), true, nil
+}
+
+// hasCanary reports whether name has canary addresses.
+func (h *HostsFile) hasCanary(name string) bool {
+	s := h.snapshot()
+	return s.hmap.canaryNames[name] || s.inline.canaryNames[name]
+}
+
+// canaryPercent returns the canary percentage of the address ip of name.
+func (h *HostsFile) canaryPercent(name string, ip net.IP) (uint8, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return 0, false
+	}
+	key := canaryKey{name: name, addr: addr.Unmap()}
+	s := h.snapshot()
+	if p, ok := s.hmap.canary[key]; ok {
+		return p, true
+	}
+	p, ok := s.inline.canary[key]
+	return p, ok
+}
+
+// canaryBucket deterministically maps client and name to a bucket in [0, 100), so a client
+// keeps getting the same addresses for a name.
+func canaryBucket(client net.IP, name string) uint8 {
+	f := fnv.New32a()
+	_, _ = f.Write(client)
+	_, _ = f.Write([]byte(name))
+	return uint8(f.Sum32() % 100)
+}
+
+// canaryAnswers returns the canary addresses of name whose percentage covers the bucket of
+// client, or the other addresses if none does. If name only has canary addresses or only other
+// addresses all of them are returned.
+func (h *EtcdHosts) canaryAnswers(name string, ips []net.IP, client net.IP) []net.IP {
+	if !h.hasCanary(name) {
+		return ips
+	}
+	bucket := canaryBucket(client, name)
+	var canary, stable []net.IP
+	hasCanary := false
+	for _, ip := range ips {
+		p, ok := h.canaryPercent(name, ip)
+		switch {
+		case !ok:
+			stable = append(stable, ip)
+		case bucket < p:
+			canary = append(canary, ip)
+			hasCanary = true
+		default:
+			hasCanary = true
+		}
+	}
+	switch {
+	case len(canary) > 0:
+		return canary
+	case len(stable) > 0 && hasCanary:
+		return stable
+	default:
+		return ips
+	}
+}
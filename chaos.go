@@ -0,0 +1,32 @@
+package etcdhosts
+
+import (
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// pluginVersion is the version of etcdhosts, it follows the CoreDNS release it is built for.
+const pluginVersion = "v1.10.1"
+
+// chaos answers the CHAOS class TXT introspection queries, it returns nil if qname isn't one of them.
+func (h *EtcdHosts) chaos(qname string) []dns.RR {
+	s := h.snapshot()
+
+	var txt string
+	switch qname {
+	case "version.etcdhosts.":
+		txt = pluginVersion
+	case "revision.etcdhosts.":
+		txt = strconv.FormatInt(s.revision, 10)
+	case "records.etcdhosts.":
+		txt = strconv.Itoa(s.inline.Len() + s.hmap.Len())
+	default:
+		return nil
+	}
+
+	return []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{txt},
+	}}
+}
@@ -0,0 +1,194 @@
+// Command etcdhostsctl manages the records of an etcdhosts plugin through its admin api, so
+// operators don't have to edit the hosts key with etcdctl.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const usage = `usage: etcdhostsctl [-addr URL] [-token TOKEN] COMMAND [ARGS]
+
+commands:
+  list                           list the records
+  get HOST                       show the record of HOST
+  add HOST IP... [-meta K=V]...  create or replace the record of HOST
+  remove HOST                    remove the record of HOST
+  validate [FILE]                validate FILE ("-" for stdin), or the hosts in etcd
+  reload [-force]                reload the hosts from etcd
+  restore [-all] NAME            restore the backup NAME
+  watch                          stream the record changes of every reload as JSON lines
+`
+
+// errUsage is returned for invalid command lines, main prints the usage for it.
+var errUsage = errors.New("invalid arguments")
+
+// client calls the admin api at addr, with a bearer token if token is set.
+type client struct {
+	addr  string
+	token string
+	out   io.Writer
+}
+
+func main() {
+	flags := flag.NewFlagSet("etcdhostsctl", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	addr := flags.String("addr", envOr("ETCDHOSTS_ADDR", "http://127.0.0.1:8053"), "address of the admin api")
+	token := flags.String("token", os.Getenv("ETCDHOSTS_TOKEN"), "admin_token of the admin api")
+	_ = flags.Parse(os.Args[1:])
+
+	c := &client{addr: strings.TrimSuffix(*addr, "/"), token: *token, out: os.Stdout}
+	if err := c.run(flags.Args()); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "etcdhostsctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command args.
+func (c *client) run(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		if len(args) != 0 {
+			return errUsage
+		}
+		return c.do(http.MethodGet, "/records", nil, "")
+	case "get":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return c.do(http.MethodGet, "/records/"+url.PathEscape(args[0]), nil, "")
+	case "add":
+		return c.add(args)
+	case "remove":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return c.do(http.MethodDelete, "/records/"+url.PathEscape(args[0]), nil, "")
+	case "validate":
+		switch len(args) {
+		case 0:
+			return c.do(http.MethodGet, "/validate", nil, "")
+		case 1:
+			data, err := readFile(args[0])
+			if err != nil {
+				return err
+			}
+			return c.do(http.MethodPost, "/validate", bytes.NewReader(data), "text/plain")
+		}
+		return errUsage
+	case "reload":
+		flags := flag.NewFlagSet("reload", flag.ContinueOnError)
+		force := flags.Bool("force", false, "ignore max_change_ratio")
+		if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+			return errUsage
+		}
+		return c.do(http.MethodPost, fmt.Sprintf("/reload?force=%t", *force), nil, "")
+	case "restore":
+		flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+		all := flags.Bool("all", false, "restore the merged and included keys as well")
+		if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+			return errUsage
+		}
+		return c.do(http.MethodPost, fmt.Sprintf("/backups/%s/restore?all=%t", url.PathEscape(flags.Arg(0)), *all), nil, "")
+	case "watch":
+		if len(args) != 0 {
+			return errUsage
+		}
+		return c.do(http.MethodGet, "/watch", nil, "")
+	}
+	return errUsage
+}
+
+// add puts the record of HOST with the addresses and -meta tags of args.
+func (c *client) add(args []string) error {
+	var record struct {
+		IPs  []string          `json:"ips"`
+		Meta map[string]string `json:"meta,omitempty"`
+	}
+	var host string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-meta" && i+1 < len(args):
+			i++
+			k, v, ok := strings.Cut(args[i], "=")
+			if !ok || k == "" {
+				return fmt.Errorf("invalid meta %q, expected KEY=VALUE", args[i])
+			}
+			if record.Meta == nil {
+				record.Meta = make(map[string]string)
+			}
+			record.Meta[k] = v
+		case host == "":
+			host = args[i]
+		default:
+			record.IPs = append(record.IPs, args[i])
+		}
+	}
+	if host == "" || len(record.IPs) == 0 {
+		return errUsage
+	}
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return c.do(http.MethodPut, "/records/"+url.PathEscape(host), bytes.NewReader(body), "application/json")
+}
+
+// do sends the request and copies the response body to c.out, or returns it as the error if
+// the response status isn't 2xx. Streamed responses are copied as they arrive.
+func (c *client) do(method, path string, body io.Reader, contentType string) error {
+	req, err := http.NewRequest(method, c.addr+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	_, err = io.Copy(c.out, resp.Body)
+	return err
+}
+
+// readFile reads name, or stdin if name is "-".
+func readFile(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+// envOr returns the environment variable key, def if it is unset.
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,145 @@
+package etcdhosts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+// consulSyncInterval is the interval between two Consul catalog syncs
+const consulSyncInterval = 30 * time.Second
+
+// consulBridge mirrors the passing instances of Consul services into the etcd hosts data,
+// every service is published as SERVICE.DOMAIN with the addresses of its healthy instances.
+type consulBridge struct {
+	h        *EtcdHosts
+	addr     string
+	domain   string
+	services []string
+	client   *http.Client
+	cancel   context.CancelFunc
+}
+
+// consulServiceEntry is the subset of a Consul health API entry the bridge uses.
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+	}
+}
+
+func newConsulBridge(h *EtcdHosts, addr, domain string, services []string) *consulBridge {
+	return &consulBridge{
+		h:        h,
+		addr:     addr,
+		domain:   domain,
+		services: services,
+		client:   &http.Client{Timeout: h.etcdConfig.Timeout},
+	}
+}
+
+// OnStartup starts the periodic Consul sync.
+func (b *consulBridge) OnStartup() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go func() {
+		tick := time.NewTicker(consulSyncInterval)
+		defer tick.Stop()
+		for {
+			b.sync(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// OnShutdown stops the periodic Consul sync.
+func (b *consulBridge) OnShutdown() error {
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return nil
+}
+
+// sync writes the passing instances of all services to etcd, nothing is written if any
+// service can't be fetched so a Consul outage doesn't remove records.
+func (b *consulBridge) sync(ctx context.Context) {
+	ips := make(map[string][]string, len(b.services))
+	for _, svc := range b.services {
+		addrs, err := b.passing(ctx, svc)
+		if err != nil {
+			log.Errorf("failed to fetch consul service [%s]: %s", svc, err)
+			return
+		}
+		ips[plugin.Name(svc+"."+b.domain).Normalize()] = addrs
+	}
+
+	names := make([]string, 0, len(ips))
+	for name := range ips {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	err := b.h.saveEtcdHosts(func(hosts []byte) ([]byte, error) {
+		for _, name := range names {
+			if len(ips[name]) == 0 {
+				hosts = removeHost(hosts, name)
+				continue
+			}
+			hosts = setHost(hosts, name, ips[name])
+		}
+		return hosts, nil
+	})
+	if err != nil {
+		log.Errorf("failed to sync consul services: %s", err)
+	}
+}
+
+// passing returns the sorted addresses of the instances of svc whose checks are all passing.
+func (b *consulBridge) passing(ctx context.Context, svc string) ([]string, error) {
+	u := fmt.Sprintf("%s/v1/health/service/%s?passing=true", b.addr, url.PathEscape(svc))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		if parseIP(addr) != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
@@ -0,0 +1,72 @@
+package etcdhosts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// credentialsCheckInterval is how often the credential files are checked for changes
+const credentialsCheckInterval = 5 * time.Second
+
+// parseCredentials parses the arguments of the credentials property, the user name and password
+// are given inline, as the names of environment variables (env USER_VAR PASSWORD_VAR) or as the
+// paths of files holding them (file USER_FILE PASSWORD_FILE).
+func (c *EtcdConfig) parseCredentials(args []string) error {
+	switch {
+	case len(args) == 3 && args[0] == "env":
+		userName, password := os.Getenv(args[1]), os.Getenv(args[2])
+		if userName == "" || password == "" {
+			return fmt.Errorf("credentials environment variables %s and %s must be set", args[1], args[2])
+		}
+		c.UserName, c.Password = userName, password
+	case len(args) == 3 && args[0] == "file":
+		userName, password, err := readCredentialFiles(args[1:])
+		if err != nil {
+			return err
+		}
+		c.UserName, c.Password = userName, password
+		c.credentialFiles = args[1:]
+	case len(args) == 2:
+		c.UserName, c.Password = args[0], args[1]
+	default:
+		return errors.New("credentials requires a username and a password, env USER_VAR PASSWORD_VAR or file USER_FILE PASSWORD_FILE")
+	}
+	return nil
+}
+
+// readCredentialFiles reads the user name and password from files, trailing newlines are removed.
+func readCredentialFiles(files []string) (string, string, error) {
+	var values [2]string
+	for i, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", "", err
+		}
+		values[i] = strings.TrimRight(string(data), "\r\n")
+		if values[i] == "" {
+			return "", "", fmt.Errorf("credentials file %s is empty", file)
+		}
+	}
+	return values[0], values[1], nil
+}
+
+// refreshCredentials re-reads the credential files and renews the etcd client if they changed,
+// the current client is kept if the files can't be read.
+func (h *EtcdHosts) refreshCredentials() {
+	userName, password, err := readCredentialFiles(h.etcdConfig.credentialFiles)
+	if err != nil {
+		log.Warningf("failed to read etcd credentials: %s", err)
+		return
+	}
+	renewed, err := renewClient(h.clientKey(), h.etcdConfig, userName, password)
+	if err != nil {
+		log.Errorf("failed to renew the etcd client with the changed credentials: %s", err)
+		return
+	}
+	if renewed {
+		log.Infof("etcd credentials changed, renewed the etcd client")
+	}
+}
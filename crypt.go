@@ -0,0 +1,77 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// encryptedPrefix marks an encrypted etcd value, it is followed by the base64 encoded nonce and
+// AES-GCM sealed data
+const encryptedPrefix = "etcdhosts:aes-gcm:"
+
+// valueCipher encrypts and decrypts etcd values with AES-GCM, the etcd key is the additional data
+// so an encrypted value can't be moved to another key. A nil valueCipher leaves values untouched.
+type valueCipher struct {
+	aead cipher.AEAD
+}
+
+// newValueCipher reads the base64 encoded 16, 24 or 32 byte AES key in file.
+func newValueCipher(file string) (*valueCipher, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key encoding in %s: %s", file, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &valueCipher{aead: aead}, nil
+}
+
+// decrypt returns the decrypted value of key, values without encryptedPrefix are returned as is.
+func (c *valueCipher) decrypt(key string, value []byte) ([]byte, error) {
+	sealed, ok := bytes.CutPrefix(value, []byte(encryptedPrefix))
+	if c == nil || !ok {
+		return value, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sealed)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted value of [%s]: %s", key, err)
+	}
+	if len(data) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid encrypted value of [%s]: too short", key)
+	}
+	nonce, sealed := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, sealed, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt [%s]: %s", key, err)
+	}
+	return plain, nil
+}
+
+// encrypt returns the encrypted value of key.
+func (c *valueCipher) encrypt(key string, data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.New("failed to generate nonce: " + err.Error())
+	}
+	sealed := c.aead.Seal(nonce, nonce, data, []byte(key))
+	return []byte(encryptedPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
@@ -0,0 +1,73 @@
+package etcdhosts
+
+import (
+	_ "embed"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reloadHistorySize is the number of reloads kept for the admin API
+const reloadHistorySize = 20
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// reloadRecord is an applied or failed reload of the hosts data.
+type reloadRecord struct {
+	Time     time.Time `json:"time"`
+	Revision int64     `json:"revision,omitempty"`
+	Records  int       `json:"records,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// reloadHistory holds the most recent reloads, oldest first.
+type reloadHistory struct {
+	sync.Mutex
+	records []reloadRecord
+}
+
+// add records a reload, the oldest reload is dropped once reloadHistorySize are kept.
+func (r *reloadHistory) add(rec reloadRecord) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.records) == reloadHistorySize {
+		r.records = append(r.records[:0], r.records[1:]...)
+	}
+	r.records = append(r.records, rec)
+}
+
+// list returns the kept reloads, most recent first.
+func (r *reloadHistory) list() []reloadRecord {
+	r.Lock()
+	defer r.Unlock()
+	records := make([]reloadRecord, len(r.records))
+	for i, rec := range r.records {
+		records[len(records)-1-i] = rec
+	}
+	return records
+}
+
+// dashboard serves the web dashboard, it shows the data of the other admin endpoints.
+func (a *admin) dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(dashboardPage)
+}
+
+// reloads lists the most recent reloads.
+func (a *admin) reloads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, a.h.reloads.list())
+}
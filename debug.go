@@ -0,0 +1,56 @@
+package etcdhosts
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// setDebugQueries sets the fraction of queries that are logged, 0 disables query logging.
+func (h *EtcdHosts) setDebugQueries(fraction float64) {
+	h.debugQueries.Store(math.Float64bits(fraction))
+}
+
+// debugQueriesFraction returns the fraction of queries that are logged.
+func (h *EtcdHosts) debugQueriesFraction() float64 {
+	return math.Float64frombits(h.debugQueries.Load())
+}
+
+// debugQuery logs how a sampled query was handled when debug_queries is enabled,
+// source tells whether the answers came from etcd, the Corefile or both.
+func (h *EtcdHosts) debugQuery(state request.Request, outcome string, answers []dns.RR) {
+	fraction := h.debugQueriesFraction()
+	if fraction <= 0 || rand.Float64() >= fraction {
+		return
+	}
+
+	var values []string
+	for _, rr := range answers {
+		switch rr := rr.(type) {
+		case *dns.A:
+			values = append(values, rr.A.String())
+		case *dns.AAAA:
+			values = append(values, rr.AAAA.String())
+		case *dns.PTR:
+			values = append(values, rr.Ptr)
+		}
+	}
+
+	qname := strings.ToLower(state.Name())
+	s := h.snapshot()
+	var source []string
+	if len(s.hmap.name4[qname]) > 0 || len(s.hmap.name6[qname]) > 0 {
+		source = append(source, "etcd")
+	}
+	if len(s.inline.name4[qname]) > 0 || len(s.inline.name6[qname]) > 0 {
+		source = append(source, "corefile")
+	}
+
+	log.Infof("query %s %s from %s: %s, revision %d, source [%s], answers [%s]",
+		state.Type(), state.Name(), state.IP(), outcome, s.revision,
+		strings.Join(source, " "), strings.Join(values, " "))
+}
@@ -0,0 +1,93 @@
+package etcdhosts
+
+import (
+	"context"
+	"sort"
+)
+
+// recordChange describes how the addresses of a single host name changed between two loads,
+// Old is empty for added hosts and New is empty for removed hosts.
+type recordChange struct {
+	Host string   `json:"host"`
+	Old  []string `json:"old,omitempty"`
+	New  []string `json:"new,omitempty"`
+}
+
+// addrsByName returns the sorted IPv4 and IPv6 addresses of every host name in the map.
+func (h *Map) addrsByName() map[string][]string {
+	ips := make(map[string][]string, len(h.sortedNames()))
+	h.forEach(func(rec adminRecord) bool {
+		ips[rec.Host] = rec.IPs
+		return true
+	})
+	return ips
+}
+
+// diffMaps compares two hosts maps and returns the changed host names sorted by name.
+func diffMaps(old, cur *Map) []recordChange {
+	oldIPs, curIPs := old.addrsByName(), cur.addrsByName()
+
+	var changes []recordChange
+	for name, ips := range curIPs {
+		if !equalStrings(oldIPs[name], ips) {
+			changes = append(changes, recordChange{Host: name, Old: oldIPs[name], New: ips})
+		}
+	}
+	for name, ips := range oldIPs {
+		if _, ok := curIPs[name]; !ok {
+			changes = append(changes, recordChange{Host: name, Old: ips})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Host < changes[j].Host })
+	return changes
+}
+
+// countChanges returns the number of added, removed and changed host names.
+func countChanges(changes []recordChange) (added, removed, changed int) {
+	for _, c := range changes {
+		switch {
+		case len(c.Old) == 0:
+			added++
+		case len(c.New) == 0:
+			removed++
+		default:
+			changed++
+		}
+	}
+	return added, removed, changed
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hostsAt returns the hosts data the etcd backend loaded at the etcd revision rev, the merged keys
+// and the #include lines are read at rev as well. rev 0 returns the current hosts.
+func (h *EtcdHosts) hostsAt(ctx context.Context, rev int64) ([]byte, error) {
+	s, ok := h.storage.(*etcdStorage)
+	if !ok {
+		return nil, errReadOnly
+	}
+	return s.loadAt(ctx, rev)
+}
+
+// diffRevisions returns the changes of the loaded hosts between the etcd revisions from and to.
+func (h *EtcdHosts) diffRevisions(ctx context.Context, from, to int64) ([]recordChange, error) {
+	old, err := h.hostsAt(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := h.hostsAt(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	return diffMaps(h.parse(old), h.parse(cur)), nil
+}
@@ -0,0 +1,43 @@
+package etcdhosts
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// discoverEndpoints resolves the etcd client endpoints from the SRV records of c.Discovery, the
+// endpoints use https if tls is configured.
+func (c *EtcdConfig) discoverEndpoints(ctx context.Context) ([]string, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", c.Discovery)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		endpoints = append(endpoints, c.scheme()+"://"+net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no SRV records for %s", c.Discovery)
+	}
+	sort.Strings(endpoints)
+	return endpoints, nil
+}
+
+// pendingEndpoints returns the endpoint of a force_start client created before the SRV records of
+// c.Discovery resolved, the client gets the discovered endpoints once they resolve.
+func (c *EtcdConfig) pendingEndpoints() []string {
+	return []string{c.scheme() + "://" + strings.TrimSuffix(c.Discovery, ".")}
+}
+
+// scheme returns the scheme of the endpoints, https if tls is configured.
+func (c *EtcdConfig) scheme() string {
+	if c.TLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,95 @@
+package etcdhosts
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// dns64 synthesizes AAAA records from A records for names without native AAAA records (RFC 6147).
+type dns64 struct {
+	// prefix is the NAT64 prefix the IPv4 addresses are embedded in
+	prefix netip.Prefix
+
+	// nets limits the synthesis to clients in these networks, empty matches every client
+	nets []*net.IPNet
+}
+
+// parseDNS64 parses a `dns64 PREFIX [CLIENT_CIDR...]` property.
+func parseDNS64(c *caddy.Controller) (*dns64, error) {
+	remaining := c.RemainingArgs()
+	if len(remaining) == 0 {
+		return nil, c.Errf("dns64 needs a NAT64 prefix like 64:ff9b::/96")
+	}
+	prefix, err := netip.ParsePrefix(remaining[0])
+	if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return nil, c.Errf("invalid NAT64 prefix '%s'", remaining[0])
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, c.Errf("NAT64 prefix length must be 32, 40, 48, 56, 64 or 96")
+	}
+	d := &dns64{prefix: prefix.Masked()}
+	for _, cidr := range remaining[1:] {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, c.Errf("invalid client network '%s'", cidr)
+		}
+		d.nets = append(d.nets, n)
+	}
+	return d, nil
+}
+
+// matches reports whether AAAA records are synthesized for client.
+func (d *dns64) matches(client net.IP) bool {
+	if len(d.nets) == 0 {
+		return true
+	}
+	if client == nil {
+		return false
+	}
+	for _, n := range d.nets {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// embed embeds ip in the prefix as described in RFC 6052 section 2.2, the bits 64 to 71 are skipped.
+func (d *dns64) embed(ip net.IP) net.IP {
+	b := d.prefix.Addr().As16()
+	pos := d.prefix.Bits() / 8
+	for _, x := range ip.To4() {
+		if pos == 8 {
+			pos++
+		}
+		b[pos] = x
+		pos++
+	}
+	return b[:]
+}
+
+// dns64Answers returns the AAAA records synthesized from the A records of qname for client, nil if
+// DNS64 is disabled or doesn't apply to client.
+func (h *EtcdHosts) dns64Answers(ctx context.Context, state request.Request, qname string, client net.IP) []dns.RR {
+	d := h.options.dns64
+	if d == nil || !d.matches(client) {
+		return nil
+	}
+	var rrs []dns.RR
+	for _, rr := range h.addrAnswers(ctx, state, qname, dns.TypeA, client) {
+		a := rr.(*dns.A)
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: a.Hdr.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: a.Hdr.Ttl},
+			AAAA: d.embed(a.A),
+		})
+	}
+	return rrs
+}
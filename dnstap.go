@@ -0,0 +1,37 @@
+package etcdhosts
+
+import (
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	"github.com/coredns/coredns/request"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// toDnstap sends the query and the authoritative response produced by etcdhosts to dnstap.
+func (h *EtcdHosts) toDnstap(state request.Request, reply *dns.Msg, start time.Time) {
+	q := new(tap.Message)
+	msg.SetQueryTime(q, start)
+	_ = msg.SetQueryAddress(q, state.W.RemoteAddr())
+	_ = msg.SetResponseAddress(q, state.W.LocalAddr())
+	if h.tapPlugin.IncludeRawMessage {
+		buf, _ := state.Req.Pack()
+		q.QueryMessage = buf
+	}
+	msg.SetType(q, tap.Message_AUTH_QUERY)
+	h.tapPlugin.TapMessage(q)
+
+	r := new(tap.Message)
+	msg.SetQueryTime(r, start)
+	msg.SetResponseTime(r, time.Now())
+	_ = msg.SetQueryAddress(r, state.W.RemoteAddr())
+	_ = msg.SetResponseAddress(r, state.W.LocalAddr())
+	if h.tapPlugin.IncludeRawMessage {
+		buf, _ := reply.Pack()
+		r.ResponseMessage = buf
+	}
+	msg.SetType(r, tap.Message_AUTH_RESPONSE)
+	h.tapPlugin.TapMessage(r)
+}
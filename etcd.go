@@ -1,9 +1,18 @@
 package etcdhosts
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -15,6 +24,29 @@ type EtcdConfig struct {
 	TLSConfig   *tls.Config
 	HostsKey    string
 	ForceReload time.Duration
+	Debounce    time.Duration
+	// DebounceMaxWait is the longest a debounced reload is delayed by a stream of watch events
+	DebounceMaxWait time.Duration
+
+	// MergeKeys are merged below HostsKey with MergePolicy, lowest priority first
+	MergeKeys   []string
+	MergePolicy string
+
+	// StagingKey holds hosts staged for review, the admin api promotes them to HostsKey
+	StagingKey string
+
+	// Discovery is the SRV name Endpoints are resolved from, empty uses the configured Endpoints
+	Discovery string
+
+	// ForceStart starts the plugin even if etcd can't be reached, the client connects and the
+	// hosts are loaded in the background
+	ForceStart bool
+
+	// tlsArgs are the arguments TLSConfig was loaded from
+	tlsArgs []string
+	// credentialFiles are the files UserName and Password were read from, they are re-read
+	// while the plugin runs
+	credentialFiles []string
 }
 
 func (c *EtcdConfig) NewClient() (*clientv3.Client, error) {
@@ -26,3 +58,476 @@ func (c *EtcdConfig) NewClient() (*clientv3.Client, error) {
 		TLS:         c.TLSConfig,
 	})
 }
+
+// newUnauthenticatedClient returns a client without credentials, unlike NewClient it does not
+// wait for etcd because no token needs to be fetched.
+func (c *EtcdConfig) newUnauthenticatedClient() (*clientv3.Client, error) {
+	return clientv3.New(clientv3.Config{
+		Endpoints: c.Endpoints,
+		TLS:       c.TLSConfig,
+	})
+}
+
+// fingerprint identifies the client configuration, configurations with the same fingerprint can share a client.
+func (c *EtcdConfig) fingerprint() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		strings.Join(c.Endpoints, ","),
+		c.UserName,
+		c.Password,
+		strings.Join(c.tlsArgs, ","),
+	}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func init() { registerBackend("etcd", newEtcdStorage) }
+
+// etcdStorage reads the hosts data from the etcd hosts key, it is the default storage.
+type etcdStorage struct {
+	h *EtcdHosts
+
+	sync.Mutex
+	// included are the keys pulled in by #include lines, they are watched once they show up
+	included map[string]bool
+	// watchCtx, watchCh and watchers belong to the running watch, watchCtx is nil until watch
+	// is called and once it is done
+	watchCtx context.Context
+	watchCh  chan struct{}
+	watchers sync.WaitGroup
+	// watchStates holds the liveness of the watch of every key
+	watchStates map[string]*watchState
+}
+
+// watchCheckInterval is how often the watches are asked for their progress and the watch metrics
+// are updated
+const watchCheckInterval = 10 * time.Second
+
+// watchState is the liveness of the watch of a key.
+type watchState struct {
+	// up is true while the watch is established
+	up atomic.Bool
+	// revision is the etcd revision of the last watch response
+	revision atomic.Int64
+	// last is the unix nano time of the last watch response
+	last atomic.Int64
+}
+
+// observe records a watch response at revision.
+func (w *watchState) observe(revision int64) {
+	w.up.Store(true)
+	w.revision.Store(revision)
+	w.last.Store(time.Now().UnixNano())
+}
+
+func newEtcdStorage(h *EtcdHosts, args []string) (storage, error) {
+	if len(args) > 0 {
+		return nil, errors.New("the etcd backend takes no arguments")
+	}
+	return &etcdStorage{h: h}, nil
+}
+
+// keys returns the merged keys and the hosts key, lowest priority first.
+func (c *EtcdConfig) keys() []string {
+	return append(c.MergeKeys[:len(c.MergeKeys):len(c.MergeKeys)], c.HostsKey)
+}
+
+// load reads all keys in a single transaction, expands their #include lines at the same etcd
+// revision and merges them, the revision is the etcd revision the keys were read at. If signatures
+// are verified every key is read together with its signature key and rejected unless its
+// signature is valid.
+func (s *etcdStorage) load(ctx context.Context) ([]byte, int64, error) {
+	r := &revisionReader{s: s, ctx: ctx}
+	data, included, err := s.assemble(r.get)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.include(included)
+	if data == nil {
+		return nil, 0, nil
+	}
+	return data, r.revision, nil
+}
+
+// loadAt returns the hosts data load returned at the etcd revision rev, 0 is the current revision.
+// Unlike load it does not watch the included keys.
+func (s *etcdStorage) loadAt(ctx context.Context, rev int64) ([]byte, error) {
+	r := &revisionReader{s: s, ctx: ctx, revision: rev}
+	data, _, err := s.assemble(r.get)
+	return data, err
+}
+
+// loadKeys reads the stored values of all keys like load, the keys are nil and the revision 0 if
+// there is no hosts data.
+func (s *etcdStorage) loadKeys(ctx context.Context) ([]storedKey, int64, error) {
+	r := &revisionReader{s: s, ctx: ctx}
+	data, _, err := s.assemble(r.get)
+	if err != nil || data == nil {
+		return nil, 0, err
+	}
+	// a key included by several keys is read several times
+	keys := make([]storedKey, 0, len(r.kvs))
+	seen := make(map[string]bool, len(r.kvs))
+	for _, kv := range r.kvs {
+		if !seen[string(kv.Key)] {
+			seen[string(kv.Key)] = true
+			keys = append(keys, storedKey{Key: string(kv.Key), Value: kv.Value, ModRevision: kv.ModRevision})
+		}
+	}
+	return keys, r.revision, nil
+}
+
+// assembleKeys returns the hosts data stored in keys, keys must hold every key load reads.
+func (s *etcdStorage) assembleKeys(keys []storedKey) ([]byte, error) {
+	stored := make(map[string]*mvccpb.KeyValue, len(keys))
+	for _, k := range keys {
+		stored[k.Key] = &mvccpb.KeyValue{Key: []byte(k.Key), Value: k.Value, ModRevision: k.ModRevision}
+	}
+	data, _, err := s.assemble(func(keys []string) ([]*mvccpb.KeyValue, error) {
+		var kvs []*mvccpb.KeyValue
+		for _, k := range keys {
+			if kv, ok := stored[k]; ok {
+				kvs = append(kvs, kv)
+			}
+		}
+		return kvs, nil
+	})
+	return data, err
+}
+
+// restoreKeys writes the stored keys back in a single transaction that fails with
+// errHostsConflict if one of the written keys changes after it was read. Unless all is set only
+// the hosts key and its signature are restored, merged and included keys may be shared with other
+// blocks.
+func (s *etcdStorage) restoreKeys(ctx context.Context, keys []storedKey, all bool) error {
+	configured := s.withSignatures(s.h.etcdConfig.keys())
+	if !all {
+		configured = s.withSignatures([]string{s.h.etcdConfig.HostsKey})
+		hostsKeys := make(map[string]bool, len(configured))
+		for _, k := range configured {
+			hostsKeys[k] = true
+		}
+		var filtered []storedKey
+		for _, k := range keys {
+			if hostsKeys[k.Key] {
+				filtered = append(filtered, k)
+			}
+		}
+		keys = filtered
+	}
+
+	restored := make(map[string]bool, len(keys))
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		restored[k.Key] = true
+		names = append(names, k.Key)
+	}
+	for _, k := range configured {
+		if !restored[k] {
+			names = append(names, k)
+		}
+	}
+
+	r := &revisionReader{s: s, ctx: ctx}
+	kvs, err := r.get(names)
+	if err != nil {
+		return err
+	}
+	modRevisions := make(map[string]int64, len(kvs))
+	for _, kv := range kvs {
+		modRevisions[string(kv.Key)] = kv.ModRevision
+	}
+
+	// a missing key has a mod revision of 0, so the compares also guard creation
+	cmps := make([]clientv3.Cmp, 0, len(names))
+	for _, k := range names {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(k), "=", modRevisions[k]))
+	}
+	ops := make([]clientv3.Op, 0, len(names))
+	for _, k := range keys {
+		ops = append(ops, clientv3.OpPut(k.Key, string(k.Value)))
+	}
+	for _, k := range names[len(keys):] {
+		if modRevisions[k] != 0 {
+			ops = append(ops, clientv3.OpDelete(k))
+		}
+	}
+
+	txnResp, err := s.h.client().Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return errHostsConflict
+	}
+	return nil
+}
+
+// assemble verifies and decrypts the keys get returns, expands their #include lines and merges
+// them. It returns nil data if none of the keys exists, and the included keys.
+func (s *etcdStorage) assemble(get func(keys []string) ([]*mvccpb.KeyValue, error)) ([]byte, []string, error) {
+	keys := s.h.etcdConfig.keys()
+	kvs, err := get(s.withSignatures(keys))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	includes := &includeResolver{get: func(key string) ([]byte, error) {
+		kvs, err := get(s.withSignatures([]string{key}))
+		if err != nil {
+			return nil, err
+		}
+		return s.verified(key, kvs)
+	}}
+
+	var sources [][]byte
+	for _, key := range keys {
+		value, err := s.verified(key, kvs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if value == nil {
+			continue
+		}
+		data, err := includes.resolve(key, value)
+		if err != nil {
+			return nil, nil, err
+		}
+		sources = append(sources, data)
+	}
+	if len(sources) == 0 {
+		return nil, includes.keys, nil
+	}
+	return mergeHosts(sources, s.h.etcdConfig.MergePolicy), includes.keys, nil
+}
+
+// revisionReader reads etcd keys at a single revision, the revision of its first read unless
+// revision is set, and keeps the key values it read.
+type revisionReader struct {
+	s        *etcdStorage
+	ctx      context.Context
+	revision int64
+	kvs      []*mvccpb.KeyValue
+}
+
+// get reads keys in a single transaction.
+func (r *revisionReader) get(keys []string) ([]*mvccpb.KeyValue, error) {
+	ops := make([]clientv3.Op, len(keys))
+	for i, k := range keys {
+		ops[i] = clientv3.OpGet(k, clientv3.WithRev(r.revision))
+	}
+	txnResp, err := r.s.h.client().Txn(r.ctx).Then(ops...).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if r.revision == 0 {
+		r.revision = txnResp.Header.Revision
+	}
+	var kvs []*mvccpb.KeyValue
+	for _, resp := range txnResp.Responses {
+		kvs = append(kvs, resp.GetResponseRange().Kvs...)
+	}
+	r.kvs = append(r.kvs, kvs...)
+	return kvs, nil
+}
+
+// withSignatures returns keys followed by the key of its signature if signatures are verified.
+func (s *etcdStorage) withSignatures(keys []string) []string {
+	if s.h.verifier == nil {
+		return keys
+	}
+	signed := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		signed = append(signed, k, s.h.verifier.signatureKey(k))
+	}
+	return signed
+}
+
+// verified returns the decrypted value of key from key values that include the keys withSignatures
+// returns for key, nil if key is missing. If signatures are verified the decrypted value must match
+// its signature.
+func (s *etcdStorage) verified(key string, kvs []*mvccpb.KeyValue) ([]byte, error) {
+	var value, signature []byte
+	found := false
+	for _, kv := range kvs {
+		switch {
+		case string(kv.Key) == key:
+			value, found = kv.Value, true
+		case s.h.verifier != nil && string(kv.Key) == s.h.verifier.signatureKey(key):
+			signature = kv.Value
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	value, err := s.h.cipher.decrypt(key, value)
+	if err != nil {
+		return nil, err
+	}
+	if s.h.verifier != nil {
+		if err := s.h.verifier.verifyKey(key, value, signature); err != nil {
+			signatureFailureCount.WithLabelValues(s.h.key).Inc()
+			return nil, err
+		}
+	}
+	if value == nil {
+		// an empty key exists, unlike a missing one
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// include records the included keys and starts watching the ones not watched yet.
+func (s *etcdStorage) include(keys []string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, key := range keys {
+		if s.included[key] {
+			continue
+		}
+		if s.included == nil {
+			s.included = make(map[string]bool)
+		}
+		s.included[key] = true
+		for _, k := range s.withSignatures([]string{key}) {
+			s.watchLocked(k)
+		}
+	}
+}
+
+// watchLocked watches key if a watch is running, s must be locked.
+func (s *etcdStorage) watchLocked(key string) {
+	if s.watchCtx == nil {
+		return
+	}
+	if s.watchStates == nil {
+		s.watchStates = make(map[string]*watchState)
+	}
+	if s.watchStates[key] == nil {
+		s.watchStates[key] = &watchState{}
+	}
+	state := s.watchStates[key]
+	s.watchers.Add(1)
+	go func() {
+		defer s.watchers.Done()
+		s.watchKey(s.watchCtx, key, s.watchCh, state)
+	}()
+}
+
+// watch watches all keys including the ones pulled in by #include lines, the watches are
+// recreated if etcd cancels them (e.g. on leader loss).
+func (s *etcdStorage) watch(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	s.Lock()
+	s.watchCtx, s.watchCh = ctx, ch
+	for _, key := range s.withSignatures(s.h.etcdConfig.keys()) {
+		s.watchLocked(key)
+	}
+	for key := range s.included {
+		for _, k := range s.withSignatures([]string{key}) {
+			s.watchLocked(k)
+		}
+	}
+	s.watchers.Add(1)
+	go func() {
+		defer s.watchers.Done()
+		s.checkWatches(ctx)
+	}()
+	s.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		// no watches are added once watchCtx is reset
+		s.Lock()
+		s.watchCtx, s.watchCh = nil, nil
+		s.Unlock()
+		s.watchers.Wait()
+		// the watch metrics are not updated any more, the instance that replaces this one on a
+		// Corefile reload reports the same block and forgetBlock removes them on shutdown
+		close(ch)
+	}()
+	return ch
+}
+
+// watchKey sends on ch whenever key changes. A watch created again after it closed also sends on
+// ch, key may have changed while it was not watched.
+func (s *etcdStorage) watchKey(ctx context.Context, key string, ch chan<- struct{}, state *watchState) {
+	defer state.up.Store(false)
+	for rewatch := false; ; rewatch = true {
+		for resp := range s.h.client().Watch(clientv3.WithRequireLeader(ctx), key, clientv3.WithCreatedNotify()) {
+			if err := resp.Err(); err != nil {
+				state.up.Store(false)
+				log.Errorf("failed to watch etcd key [%s]: %s", key, err)
+				continue
+			}
+			state.observe(resp.Header.Revision)
+			if resp.Created && !rewatch || resp.IsProgressNotify() {
+				continue
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		state.up.Store(false)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+			log.Warningf("etcd watch of key [%s] closed, rewatching", key)
+		}
+	}
+}
+
+// checkWatches asks the watches for their progress every watchCheckInterval and updates the watch
+// metrics until ctx is done. The revision gap is measured against the cluster revision of the
+// previous check, so a watch that answered the progress request of the previous check has no gap.
+func (s *etcdStorage) checkWatches(ctx context.Context) {
+	ticker := time.NewTicker(watchCheckInterval)
+	defer ticker.Stop()
+
+	var clusterRevision int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.observeWatches(clusterRevision)
+
+		tctx, cancel := context.WithTimeout(ctx, s.h.etcdConfig.Timeout)
+		resp, err := s.h.client().Get(tctx, s.h.etcdConfig.HostsKey, clientv3.WithCountOnly())
+		if err == nil {
+			clusterRevision = resp.Header.Revision
+			// the progress responses arrive on the watch streams of ctx
+			err = s.h.client().RequestProgress(clientv3.WithRequireLeader(tctx))
+		}
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Warningf("failed to check the etcd watches: %s", err)
+		}
+	}
+}
+
+// observeWatches updates the watch metrics of all watched keys, the revision gap is left
+// untouched if clusterRevision is 0.
+func (s *etcdStorage) observeWatches(clusterRevision int64) {
+	s.Lock()
+	defer s.Unlock()
+	for key, state := range s.watchStates {
+		up := 0.0
+		if state.up.Load() {
+			up = 1
+		}
+		watchUp.WithLabelValues(s.h.key, key).Set(up)
+		if last := state.last.Load(); last != 0 {
+			watchIdleSeconds.WithLabelValues(s.h.key, key).Set(time.Since(time.Unix(0, last)).Seconds())
+		}
+		if clusterRevision != 0 {
+			watchRevisionGap.WithLabelValues(s.h.key, key).Set(math.Max(0, float64(clusterRevision-state.revision.Load())))
+		}
+	}
+}
+
+func (s *etcdStorage) String() string { return strings.Join(s.h.etcdConfig.keys(), ",") }
@@ -0,0 +1,104 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// expiresTag is the tag that sets the expiry of a hosts line as RFC 3339 timestamp, expired lines
+// are skipped, e.g. `10.0.0.9 www.example.com # expires=2024-01-31T00:00:00Z`.
+const expiresTag = "expires"
+
+// startsTag is the tag that sets the start of a hosts line as RFC 3339 timestamp, lines are skipped
+// until they start. Together with expires it limits a line to a time window.
+const startsTag = "starts"
+
+// timedCheckInterval is the interval the loaded hosts are checked for lines that started or expired
+const timedCheckInterval = time.Second
+
+// lineTime returns the RFC 3339 timestamp of the tag key in the comment of a hosts line, ok is
+// false if the line has no such tag and err is set if the timestamp is invalid.
+func lineTime(comment []byte, key string) (t time.Time, ok bool, err error) {
+	v, found := lineTag(comment, key)
+	if !found {
+		return time.Time{}, false, nil
+	}
+	t, err = time.Parse(time.RFC3339, string(v))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t, true, nil
+}
+
+// lineExpiry returns the expiry of the comment of a hosts line, ok is false if the line doesn't
+// expire and err is set if the timestamp is invalid.
+func lineExpiry(comment []byte) (expires time.Time, ok bool, err error) {
+	return lineTime(comment, expiresTag)
+}
+
+// lineActive reports whether the line of comment is active at now and returns the next time this
+// changes, zero if it never does. err is set if a timestamp is invalid, the line is active then.
+func lineActive(comment []byte, now time.Time) (active bool, next time.Time, err error) {
+	starts, hasStart, err1 := lineTime(comment, startsTag)
+	expires, hasExpiry, err2 := lineExpiry(comment)
+	if err1 != nil || err2 != nil {
+		return true, time.Time{}, errors.Join(err1, err2)
+	}
+	switch {
+	case hasExpiry && !now.Before(expires):
+		return false, time.Time{}, nil
+	case hasStart && now.Before(starts):
+		return false, starts, nil
+	case hasExpiry:
+		return true, expires, nil
+	default:
+		return true, time.Time{}, nil
+	}
+}
+
+// outdated reports whether a line of the map started or expired since it was parsed.
+func (h *Map) outdated(now time.Time) bool {
+	return !h.nextChange.IsZero() && !now.Before(h.nextChange)
+}
+
+// refreshTimedHosts parses the loaded hosts again once one of their lines started or expired, the
+// storage is not read. With expire_gc the expired lines are also removed from etcd, a failed
+// removal is not retried until the next line expires.
+func (h *EtcdHosts) refreshTimedHosts() {
+	now := time.Now()
+	s := h.snapshot()
+	if s.hmap.outdated(now) && s.data != nil {
+		if h.expireGC && h.etcdClient != nil {
+			err := h.saveEtcdHosts(func(hosts []byte) ([]byte, error) {
+				return removeExpired(hosts, now), nil
+			})
+			if err != nil {
+				log.Errorf("failed to remove expired hosts from [%s]: %s", h.etcdConfig.HostsKey, err)
+			}
+		}
+		log.Info("etcdhosts re-evaluating timed hosts...")
+		if oldMap, newMap := h.readHosts(s.data, s.revision, false); newMap != nil {
+			h.hostsChanged(oldMap, newMap, s.revision, s.revision)
+		}
+	}
+	if s.inline.outdated(now) {
+		h.inlineMtime = time.Time{}
+		h.initInline(h.inlineLines)
+	}
+}
+
+// removeExpired drops the lines that expired at now.
+func removeExpired(hosts []byte, now time.Time) []byte {
+	var buf bytes.Buffer
+	for _, line := range hostsLines(hosts) {
+		if i := bytes.IndexByte(line, '#'); i >= 0 {
+			if expires, ok, _ := lineExpiry(line[i+1:]); ok && !now.Before(expires) {
+				continue
+			}
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
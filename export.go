@@ -0,0 +1,82 @@
+package etcdhosts
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// exportZone renders all records below origin, from etcd and the Corefile, as an RFC 1035 zone file.
+// PTR records are rendered when origin is a reverse zone and auto reverse is enabled. If a SOA is
+// configured for origin the zone starts with the SOA and an NS record of its MNAME.
+func (h *EtcdHosts) exportZone(w io.Writer, origin string) error {
+	origin = dns.Fqdn(origin)
+
+	s := h.snapshot()
+	var rrs []dns.RR
+	for _, m := range []*Map{s.hmap, s.inline} {
+		for name, ips := range m.name4 {
+			if dns.IsSubDomain(origin, name) {
+				rrs = append(rrs, a(name, h.options.ttlFor(name), asIPs4(ips))...)
+			}
+		}
+		for name, ips := range m.name6 {
+			if dns.IsSubDomain(origin, name) {
+				rrs = append(rrs, aaaa(name, h.options.ttlFor(name), asIPs6(ips))...)
+			}
+		}
+		addrs := make(map[string][]string, len(m.addr4)+len(m.addr6))
+		for addr, names := range m.addr4 {
+			addrs[netip.AddrFrom4(addr).String()] = names
+		}
+		for addr, names := range m.addr6 {
+			addrs[netip.AddrFrom16(addr).String()] = names
+		}
+		for addr, names := range addrs {
+			reverse, err := dns.ReverseAddr(addr)
+			if err != nil || !dns.IsSubDomain(origin, reverse) {
+				continue
+			}
+			for _, name := range names {
+				rrs = append(rrs, &dns.PTR{
+					Hdr: dns.RR_Header{Name: reverse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: h.options.ttlFor(reverse)},
+					Ptr: dns.Fqdn(name),
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(rrs, func(i, j int) bool {
+		if rrs[i].Header().Name != rrs[j].Header().Name {
+			return rrs[i].Header().Name < rrs[j].Header().Name
+		}
+		return rrs[i].Header().Rrtype < rrs[j].Header().Rrtype
+	})
+
+	zone := plugin.Zones(h.Origins).Matches(origin)
+	if zone == "" {
+		zone = plugin.Zones(s.reverseZones).Matches(origin)
+	}
+	if soa := h.soa(origin, zone); soa != nil && soa.Hdr.Name == origin {
+		ns := &dns.NS{
+			Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: soa.Hdr.Ttl},
+			Ns:  soa.Ns,
+		}
+		rrs = append([]dns.RR{soa, ns}, rrs...)
+	}
+
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n", origin, h.options.ttl); err != nil {
+		return err
+	}
+	for _, rr := range rrs {
+		if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package etcdhosts
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// filePollInterval is the interval the hosts file is checked if it can't be watched
+const filePollInterval = 5 * time.Second
+
+func init() { registerBackend("file", newFileStorage) }
+
+// fileStorage reads the hosts data from a local file, the revision is the modification time of
+// the file.
+type fileStorage struct {
+	path string
+}
+
+func newFileStorage(h *EtcdHosts, args []string) (storage, error) {
+	if len(args) != 1 {
+		return nil, errors.New("the file backend needs a file path")
+	}
+	return &fileStorage{path: filepath.Clean(args[0])}, nil
+}
+
+func (s *fileStorage) load(ctx context.Context) ([]byte, int64, error) {
+	stat, err := os.Stat(s.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, stat.ModTime().UnixNano(), nil
+}
+
+// watch watches the directory of the file, so files replaced by a rename (editors, Kubernetes
+// ConfigMaps) are picked up too. The file is polled if it can't be watched.
+func (s *fileStorage) watch(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		defer close(ch)
+
+		w, err := fsnotify.NewWatcher()
+		if err == nil {
+			if err = w.Add(filepath.Dir(s.path)); err != nil {
+				w.Close()
+			}
+		}
+		if err != nil {
+			log.Warningf("failed to watch hosts file [%s], polling every %s: %s", s.path, filePollInterval, err)
+			tick := time.NewTicker(filePollInterval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick.C:
+					notify()
+				}
+			}
+		}
+		defer w.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				notify()
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warningf("failed to watch hosts file [%s]: %s", s.path, err)
+			}
+		}
+	}()
+	return ch
+}
+
+func (s *fileStorage) String() string { return s.path }
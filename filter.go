@@ -0,0 +1,69 @@
+package etcdhosts
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// answerFilter suppresses the answers of qtype for dual-stack names, so clients fall back to the
+// other address family.
+type answerFilter struct {
+	// qtype is the suppressed type, dns.TypeA or dns.TypeAAAA
+	qtype uint16
+
+	// nets limits the filter to clients in these networks, empty matches every client
+	nets []*net.IPNet
+}
+
+// matches reports whether the filter applies to a query of qtype sent by client.
+func (f *answerFilter) matches(qtype uint16, client net.IP) bool {
+	if f.qtype != qtype {
+		return false
+	}
+	if len(f.nets) == 0 {
+		return true
+	}
+	if client == nil {
+		return false
+	}
+	for _, n := range f.nets {
+		if n.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// filtered reports whether the qtype answers of name are suppressed for client.
+func (o *options) filtered(name string, qtype uint16, client net.IP) bool {
+	filters := o.filters
+	if zo := o.zoneOptions(name); zo != nil {
+		filters = append(filters[:len(filters):len(filters)], zo.filters...)
+	}
+	for _, f := range filters {
+		if f.matches(qtype, client) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAnswers returns nil instead of the qtype answers of name if a filter applies to client
+// and name has addresses of the other family.
+func (h *EtcdHosts) filterAnswers(name string, qtype uint16, client net.IP, answers []dns.RR) []dns.RR {
+	if len(answers) == 0 || !h.options.filtered(name, qtype, client) {
+		return answers
+	}
+	switch qtype {
+	case dns.TypeA:
+		if len(h.LookupStaticHostV6(name)) == 0 {
+			return answers
+		}
+	case dns.TypeAAAA:
+		if len(h.LookupStaticHostV4(name)) == 0 {
+			return answers
+		}
+	}
+	return nil
+}
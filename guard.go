@@ -0,0 +1,49 @@
+package etcdhosts
+
+// removedRatio returns the fraction of the address records of old that are missing in new.
+func removedRatio(old, new *Map) float64 {
+	total, removed := 0, 0
+	for name, addrs := range old.name4 {
+		total += len(addrs)
+		removed += countMissing(addrs, new.name4[name])
+	}
+	for name, addrs := range old.name6 {
+		total += len(addrs)
+		removed += countMissing(addrs, new.name6[name])
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(removed) / float64(total)
+}
+
+// countMissing returns the number of elements of old that are not in new.
+func countMissing[T comparable](old, new []T) int {
+	n := 0
+outer:
+	for _, o := range old {
+		for _, v := range new {
+			if o == v {
+				continue outer
+			}
+		}
+		n++
+	}
+	return n
+}
+
+// guardRejects reports whether newMap removes more than max_change_ratio of the records of
+// oldMap, the rejected revision is logged and counted.
+func (h *HostsFile) guardRejects(oldMap, newMap *Map, revision int64) bool {
+	if h.options.maxChangeRatio == 0 || oldMap.Len() == 0 {
+		return false
+	}
+	ratio := removedRatio(oldMap, newMap)
+	if ratio <= h.options.maxChangeRatio {
+		return false
+	}
+	refusedReloadCount.WithLabelValues(h.key).Inc()
+	log.Errorf("refusing hosts revision %d, it removes %.1f%% of the records (max_change_ratio %.1f%%), "+
+		"keeping the previous hosts until a forced reload", revision, ratio*100, h.options.maxChangeRatio*100)
+	return true
+}
@@ -1,17 +1,25 @@
 package etcdhosts
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"net"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
 	"github.com/coredns/coredns/plugin/pkg/dnsutil"
 	"github.com/coredns/coredns/plugin/pkg/fall"
+	"github.com/coredns/coredns/plugin/pkg/upstream"
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
 )
 
 // EtcdHosts is the plugin handler
@@ -19,62 +27,266 @@ type EtcdHosts struct {
 	Next plugin.Handler
 	*HostsFile
 	etcdConfig *EtcdConfig
-	etcdClient *clientv3.Client
+	// etcdClient is nil unless the etcd backend is used, use client to get the current client
+	etcdClient *sharedClient
+	storage    storage
 	Fall       fall.F
+	FallNoData fall.F
+
+	// adminAddr is the listen address of the admin API, empty disables it
+	adminAddr string
+	// adminAuth authenticates and authorizes the admin API clients
+	adminAuth adminAuth
+	// reloads holds the most recent reloads for the admin API
+	reloads reloadHistory
+
+	// verifier checks the signatures of the etcd keys, nil if the keys are not signed
+	verifier *verifier
+	// cipher decrypts and encrypts the etcd values, nil if the values are not encrypted
+	cipher *valueCipher
+	// reloadCh asks the update goroutine to reload hosts from etcd, a true value forces the reload
+	// past max_change_ratio
+	reloadCh chan bool
+
+	// loaded is set once hosts were loaded from the storage
+	loaded atomic.Bool
+
+	// webhook is notified after every reload, nil if not configured
+	webhook *webhook
+	// auditLog and auditPrefix are the file and etcd prefix changes are recorded to
+	auditLog    string
+	auditPrefix string
+	// auditRetention is how long the entries below auditPrefix are kept, 0 keeps them forever
+	auditRetention time.Duration
+	// changes streams the record changes of every reload to the admin api watchers
+	changes changeFeed
+
+	// dryRun loads and validates hosts without answering any queries
+	dryRun bool
+
+	// consul mirrors Consul services into etcd, nil if not configured
+	consul *consulBridge
+
+	// registration publishes the instance in etcd, nil if not configured
+	registration *registration
+
+	// expireGC removes expired lines from etcd
+	expireGC bool
+
+	// backups snapshots the hosts data to disk, nil if not configured
+	backups *backups
+
+	// staleThreshold marks the plugin unhealthy once etcd was unreachable for longer, 0 disables it
+	staleThreshold time.Duration
+	// lastContact is the unix nano time etcd was last reached successfully
+	lastContact atomic.Int64
+
+	// tapPlugin is the dnstap plugin of the server block, nil if dnstap is not enabled
+	tapPlugin *dnstap.Dnstap
+	// tracer is the tracer of the trace plugin, a noop tracer if trace is not enabled
+	tracer ot.Tracer
+
+	// upstream resolves ALIAS targets that are not in the store, aliases caches the results
+	upstream *upstream.Upstream
+	aliases  *aliasCache
+
+	// debugQueries holds the float64 bits of the fraction of queries that are logged
+	debugQueries atomic.Uint64
+
+	// limiter limits the queries per second of every client network, nil if not configured
+	limiter *rateLimiter
 }
 
+// errHostsConflict is returned when the etcd hosts key was modified between read and write.
+var errHostsConflict = errors.New("etcd hosts key was modified concurrently")
+
 // ServeDNS implements the plugin.Handle interface.
 func (h *EtcdHosts) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if h.dryRun {
+		return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+	}
+
+	start := time.Now()
 	state := request.Request{W: w, Req: r}
 	qname := state.Name()
 
 	var answers []dns.RR
 
+	if state.QClass() == dns.ClassCHAOS && state.QType() == dns.TypeTXT {
+		answers = h.chaos(strings.ToLower(qname))
+		if len(answers) == 0 {
+			return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = answers
+		_ = w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	}
+
 	zone := plugin.Zones(h.Origins).Matches(qname)
+	// authority is the zone whose SOA is used, PTR names outside Origins use the derived reverse zones
+	authority := zone
 	if zone == "" {
+		authority = plugin.Zones(h.snapshot().reverseZones).Matches(qname)
 		// PTR zones don't need to be specified in Origins.
-		if state.QType() != dns.TypePTR {
+		if state.QType() != dns.TypePTR && (state.QType() != dns.TypeSOA || !h.isApex(qname, authority)) {
 			// if this doesn't match we need to fall through regardless of h.Fallthrough
 			return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
 		}
 	}
 
-	switch state.QType() {
-	case dns.TypePTR:
+	if h.limiter != nil && !h.limiter.allow(state.IP(), start) {
+		return h.rateLimited(state)
+	}
+
+	responses := h.snapshot().responses
+	if responses != nil {
+		// a response cached for a TCP query may not fit the buffer of a UDP query
+		if buf, n := responses.get(r); buf != nil && len(buf) <= state.Size() {
+			_, _ = w.Write(buf)
+			h.debugQuery(state, "answered from cache", nil)
+			observeQuery(zone, state.QType(), dns.RcodeSuccess, n)
+			return dns.RcodeSuccess, nil
+		}
+	}
+
+	// missing names skip the lookups, PTR queries are never cached as missing because a reverse
+	// name can also be in Origins
+	misses := h.snapshot().misses
+	missing := state.QType() != dns.TypePTR && misses.has(qname)
+
+	client := net.ParseIP(state.IP())
+	switch {
+	case missing:
+	case state.QType() == dns.TypePTR:
+		if !h.options.answersReverse(qname) {
+			// PTR queries outside the reverse ranges always fall through
+			return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+		}
 		names := h.LookupStaticAddr(dnsutil.ExtractAddressFromReverse(qname))
 		if len(names) == 0 {
 			// If this doesn't match we need to fall through regardless of h.Fallthrough
 			return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
 		}
-		answers = h.ptr(qname, h.options.ttl, names)
-	case dns.TypeA:
-		ips := h.LookupStaticHostV4(qname)
-		answers = a(qname, h.options.ttl, ips)
-	case dns.TypeAAAA:
-		ips := h.LookupStaticHostV6(qname)
-		answers = aaaa(qname, h.options.ttl, ips)
+		if h.options.ptrCanonical {
+			names = names[:1]
+		}
+		answers = h.ptr(qname, h.options.ttlFor(qname), names)
+	case state.QType() == dns.TypeA, state.QType() == dns.TypeAAAA:
+		answers = h.addrAnswers(ctx, state, qname, state.QType(), client)
+		if len(answers) == 0 && state.QType() == dns.TypeAAAA {
+			answers = h.dns64Answers(ctx, state, qname, client)
+		}
+	case state.QType() == dns.TypeSOA:
+		if soa := h.soa(qname, authority); soa != nil && soa.Hdr.Name == qname {
+			answers = []dns.RR{soa}
+		}
+	case state.QType() == dns.TypeANY:
+		// RFC 8482: answer ANY with a single synthesized HINFO record instead of all records
+		if h.otherRecordsExist(qname) || h.isApex(qname, authority) {
+			answers = []dns.RR{h.anyHINFO(qname)}
+		}
 	}
+	answers = h.filterAnswers(qname, state.QType(), client, answers)
 
-	// Only on NXDOMAIN we will fallthrough.
-	if len(answers) == 0 && !h.otherRecordsExist(qname) {
+	// On NXDOMAIN we fallthrough with fallthrough.
+	if missing || len(answers) == 0 && !h.otherRecordsExist(qname) && !h.isApex(qname, authority) {
+		if !missing && state.QType() != dns.TypePTR {
+			misses.add(qname)
+		}
 		if h.Fall.Through(qname) {
+			h.debugQuery(state, "not found, fallthrough", nil)
 			return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
 		}
 
+		// With a SOA we can send a proper NXDOMAIN.
+		if ns := h.negativeSOA(qname, authority); ns != nil {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			m.Authoritative = true
+			m.Ns = ns
+			state.SizeAndDo(m)
+			h.setNSID(r, m)
+			if h.tapPlugin != nil {
+				h.toDnstap(state, m, start)
+			}
+			_ = w.WriteMsg(m)
+			h.debugQuery(state, "not found", nil)
+			observeQuery(zone, state.QType(), dns.RcodeNameError, 0)
+			return dns.RcodeNameError, nil
+		}
+
 		// We want to send an NXDOMAIN, but because of /etc/hosts' setup we don't have a SOA, so we make it SERVFAIL
 		// to at least give an answer back to signals we're having problems resolving this.
+		h.debugQuery(state, "not found", nil)
+		observeQuery(zone, state.QType(), dns.RcodeServerFailure, 0)
 		return dns.RcodeServerFailure, nil
 	}
 
+	// On NODATA, the name exists without records of the query type, we fallthrough with fallthrough_nodata.
+	if len(answers) == 0 && h.FallNoData.Through(qname) {
+		h.debugQuery(state, "no data, fallthrough", nil)
+		return plugin.NextOrFailure(h.Name(), h.Next, ctx, w, r)
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = true
-	m.Answer = answers
+	m.Answer = h.options.jitterTTL(answers)
+	if len(answers) == 0 {
+		m.Ns = h.negativeSOA(qname, authority)
+	}
+
+	// Mirror the EDNS0 option of the query and drop the answers that don't fit the advertised
+	// buffer size, the client retries over TCP when TC is set.
+	state.SizeAndDo(m)
+	h.setNSID(r, m)
+	m = state.Scrub(m)
+
+	if span := ot.SpanFromContext(ctx); span != nil {
+		span.SetTag("etcdhosts.revision", h.snapshot().revision)
+		span.SetTag("etcdhosts.answers", len(m.Answer))
+	}
+
+	if h.tapPlugin != nil {
+		h.toDnstap(state, m, start)
+	}
+
+	// Truncated responses aren't cached, a retry over the same transport would be truncated again
+	// anyway but a retry over TCP must get all answers.
+	if responses != nil && !m.Truncated && h.cachesResponse(qname) {
+		responses.add(r, m)
+	}
 
 	_ = w.WriteMsg(m)
+	h.debugQuery(state, "answered", m.Answer)
+	observeQuery(zone, state.QType(), dns.RcodeSuccess, len(m.Answer))
 	return dns.RcodeSuccess, nil
 }
 
+// sortAnswer sorts the addresses of an answer according to the configured order.
+func (h *EtcdHosts) sortAnswer(ips []net.IP, client net.IP) {
+	if h.options.order == orderRFC6724 {
+		sortRFC6724(ips, client)
+	}
+}
+
+// anyHINFO returns the HINFO record answering an ANY query for qname.
+func (h *EtcdHosts) anyHINFO(qname string) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: h.options.ttlFor(qname)},
+		Cpu: h.options.anyCPU,
+		Os:  h.options.anyOS,
+	}
+}
+
+// isApex reports whether qname owns the SOA of its zone.
+func (h *EtcdHosts) isApex(qname, zone string) bool {
+	owner, so := h.options.soaFor(qname, zone)
+	return so != nil && owner == qname
+}
+
 func (h *EtcdHosts) otherRecordsExist(qname string) bool {
 	if len(h.LookupStaticHostV4(qname)) > 0 {
 		return true
@@ -82,6 +294,9 @@ func (h *EtcdHosts) otherRecordsExist(qname string) bool {
 	if len(h.LookupStaticHostV6(qname)) > 0 {
 		return true
 	}
+	if h.LookupStaticAlias(qname) != "" {
+		return true
+	}
 	return false
 }
 
@@ -124,45 +339,227 @@ func (h *EtcdHosts) ptr(zone string, ttl uint32, names []string) []dns.RR {
 	return answers
 }
 
-// readEtcdHosts load hosts config from etcd
-func (h *EtcdHosts) readEtcdHosts() {
+// loadHosts loads the hosts data from the storage, with force it is applied even if it removes more
+// than max_change_ratio of the records.
+func (h *EtcdHosts) loadHosts(force bool) {
+	span := h.tracer.StartSpan("etcdhosts.load")
+	defer span.Finish()
+	span.SetTag("etcdhosts.key", h.storage.String())
+
 	ctx, cancel := context.WithTimeout(context.Background(), h.etcdConfig.Timeout)
 	defer cancel()
 
-	getResp, err := h.etcdClient.Get(ctx, h.etcdConfig.HostsKey)
+	getSpan := h.tracer.StartSpan("etcdhosts.storage_load", ot.ChildOf(span.Context()))
+	data, revision, err := h.storage.load(ctx)
+	getSpan.Finish()
 	if err != nil {
-		log.Errorf("failed to get etcd key [%s]: %s", h.etcdConfig.HostsKey, err.Error())
+		span.SetTag("error", true)
+		reloadFailureCount.WithLabelValues(h.key).Inc()
+		h.reloads.add(reloadRecord{Time: time.Now().UTC(), Error: err.Error()})
+		log.Errorf("failed to load hosts [%s]: %s", h.storage, err.Error())
+		return
+	}
+
+	if revision == 0 {
+		span.SetTag("error", true)
+		reloadFailureCount.WithLabelValues(h.key).Inc()
+		h.reloads.add(reloadRecord{Time: time.Now().UTC(), Error: "no hosts data"})
+		log.Errorf("no hosts data in [%s]", h.storage)
+		return
+	}
+	reloadCount.WithLabelValues(h.key).Inc()
+	h.touch()
+	h.loaded.Store(true)
+
+	span.SetTag("etcdhosts.revision", revision)
+	if h.dryRun {
+		for _, f := range h.validateHosts(data) {
+			log.Warningf("hosts [%s] %s", h.storage, f)
+		}
+	}
+
+	oldRevision := h.snapshot().revision
+
+	updateSpan := h.tracer.StartSpan("etcdhosts.store_update", ot.ChildOf(span.Context()))
+	oldMap, newMap := h.readHosts(data, revision, force)
+	updateSpan.Finish()
+	if newMap == nil {
 		return
 	}
+	span.SetTag("etcdhosts.records", newMap.Len())
+	h.reloads.add(reloadRecord{Time: time.Now().UTC(), Revision: revision, Records: newMap.Len()})
+	saveStore(h.key, storeState{
+		hmap:        newMap,
+		revision:    revision,
+		digest:      hostsDigest(data),
+		data:        h.snapshot().data,
+		fingerprint: h.parseFingerprint(),
+	})
+	h.hostsChanged(oldMap, newMap, oldRevision, revision)
+}
 
-	if len(getResp.Kvs) != 1 {
-		log.Errorf("invalid etcd response: %d", len(getResp.Kvs))
+// hostsChanged reports the changes of a reload to the configured webhooks, audit trail and
+// admin api watchers
+func (h *EtcdHosts) hostsChanged(oldMap, newMap *Map, oldRevision, revision int64) {
+	watched := h.changes.watched()
+	if h.webhook == nil && h.auditLog == "" && h.auditPrefix == "" && !watched {
 		return
 	}
 
-	h.readHosts(getResp.Kvs[0].Value, getResp.Kvs[0].Version)
+	now := time.Now().UTC()
+	changes := diffMaps(oldMap, newMap)
+	if watched {
+		events := make([]changeEvent, len(changes))
+		for i, c := range changes {
+			events[i] = changeEvent{Time: now, Key: h.storage.String(), OldRevision: oldRevision, Revision: revision, recordChange: c}
+		}
+		h.changes.publish(events)
+	}
+	if h.webhook != nil {
+		added, removed, changed := countChanges(changes)
+		h.webhook.notify(webhookPayload{
+			Key:         h.storage.String(),
+			OldRevision: oldRevision,
+			Revision:    revision,
+			Added:       added,
+			Removed:     removed,
+			Changed:     changed,
+		})
+	}
+	h.audit(auditEntry{
+		Time:        now,
+		Key:         h.storage.String(),
+		OldRevision: oldRevision,
+		Revision:    revision,
+		Changes:     changes,
+	})
 }
 
-// initEtcdClient create etcd client
+// saveEtcdHosts applies update to the hosts data stored in etcd, the write only succeeds
+// if the key has not been modified since it was read (compare-and-swap).
+func (h *EtcdHosts) saveEtcdHosts(update func(hosts []byte) ([]byte, error)) error {
+	if h.etcdClient == nil {
+		return errReadOnly
+	}
+	if h.verifier != nil {
+		return errSigned
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.etcdConfig.Timeout)
+	defer cancel()
+
+	getResp, err := h.client().Get(ctx, h.etcdConfig.HostsKey)
+	if err != nil {
+		return err
+	}
+
+	// a missing key has a mod revision of 0, so the compare below also guards creation
+	var hosts []byte
+	var modRevision int64
+	if len(getResp.Kvs) == 1 {
+		if hosts, err = h.cipher.decrypt(h.etcdConfig.HostsKey, getResp.Kvs[0].Value); err != nil {
+			return err
+		}
+		modRevision = getResp.Kvs[0].ModRevision
+	}
+
+	newHosts, err := update(hosts)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(newHosts, hosts) {
+		return nil
+	}
+	value, err := h.cipher.encrypt(h.etcdConfig.HostsKey, newHosts)
+	if err != nil {
+		return err
+	}
+
+	txnResp, err := h.client().Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(h.etcdConfig.HostsKey), "=", modRevision)).
+		Then(clientv3.OpPut(h.etcdConfig.HostsKey, string(value))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txnResp.Succeeded {
+		return errHostsConflict
+	}
+	return nil
+}
+
+// triggerReload asks the update goroutine to reload hosts from the storage, with force the reload
+// is applied even if it removes more than max_change_ratio of the records.
+func (h *EtcdHosts) triggerReload(force bool) {
+	for {
+		select {
+		case h.reloadCh <- force:
+			return
+		default:
+		}
+		// replace the pending reload so a forced reload is never lost
+		select {
+		case pending := <-h.reloadCh:
+			force = force || pending
+		default:
+		}
+	}
+}
+
+// touch records a successful contact with the storage
+func (h *EtcdHosts) touch() {
+	h.lastContact.Store(time.Now().UnixNano())
+}
+
+// stale reports whether the storage has been unreachable for longer than the stale threshold
+func (h *EtcdHosts) stale() bool {
+	if h.staleThreshold == 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, h.lastContact.Load())) > h.staleThreshold
+}
+
+// clientKey is the registry key of the etcd client of the instance, instances with the same
+// endpoints, credentials and tls settings share a client
+func (h *EtcdHosts) clientKey() string {
+	return h.etcdConfig.fingerprint()
+}
+
+// initEtcdClient create etcd client, the client of an instance with the same configuration
+// (including the instance replaced by a Corefile reload) is reused
 func (h *EtcdHosts) initEtcdClient() error {
-	cli, err := h.etcdConfig.NewClient()
+	sc, err := acquireClient(h.clientKey(), h.etcdConfig)
 	if err == nil {
-		h.Lock()
-		h.etcdClient = cli
-		h.Unlock()
+		h.etcdClient = sc
 	}
 	return err
 }
 
-// closeClient close etcd client
+// client returns the current etcd client, the client is replaced when the credentials change.
+func (h *EtcdHosts) client() *clientv3.Client {
+	return h.etcdClient.client.Load()
+}
+
+// closeClient release etcd client, it is closed once no instance uses it
 func (h *EtcdHosts) closeClient() error {
-	return h.etcdClient.Close()
+	if h.etcdClient == nil {
+		return nil
+	}
+	return releaseClient(h.clientKey())
 }
 
-// syncEndpoints sync etcd client endpoints
+// syncEndpoints sync etcd client endpoints, from the SRV records if discovery is configured
 func (h *EtcdHosts) syncEndpoints() error {
 	ctx, syncCancel := context.WithTimeout(context.Background(), h.etcdConfig.Timeout)
 	defer syncCancel()
 
-	return h.etcdClient.Sync(ctx)
+	if h.etcdConfig.Discovery != "" {
+		endpoints, err := h.etcdConfig.discoverEndpoints(ctx)
+		if err != nil {
+			return err
+		}
+		h.client().SetEndpoints(endpoints...)
+		return nil
+	}
+	return h.client().Sync(ctx)
 }
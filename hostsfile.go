@@ -7,14 +7,20 @@
 package etcdhosts
 
 import (
-	"bufio"
 	"bytes"
-	"io"
+	"hash/fnv"
 	"net"
+	"net/netip"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+
+	"github.com/miekg/dns"
 )
 
 // parseIP calls discards any v6 zone info, before calling net.ParseIP.
@@ -27,6 +33,33 @@ func parseIP(addr string) net.IP {
 	return net.ParseIP(addr)
 }
 
+// parseAddr is parseIP for the addresses stored in a Map, IPv4-mapped IPv6 addresses are
+// stored as IPv4 addresses like net.IP.To4 would.
+func parseAddr(addr string) (netip.Addr, bool) {
+	if i := strings.Index(addr, "%"); i >= 0 {
+		// discard ipv6 zone
+		addr = addr[0:i]
+	}
+
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
+
+// hostsLines splits hosts into its lines like bufio.ScanLines, but without a maximum line length.
+func hostsLines(hosts []byte) [][]byte {
+	lines := bytes.Split(hosts, []byte{'\n'})
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		lines[i] = bytes.TrimSuffix(line, []byte{'\r'})
+	}
+	return lines
+}
+
 type options struct {
 	// automatically generate IP to Hostname PTR entries
 	// for host entries we parse
@@ -34,36 +67,184 @@ type options struct {
 
 	// The TTL of the record we generate
 	ttl uint32
+
+	// per zone overrides of the options above
+	zones []*zoneOptions
+
+	// reverseNets and reverseZones limit the PTR queries we answer, all PTR queries are
+	// answered if both are empty
+	reverseNets  []*net.IPNet
+	reverseZones []string
+
+	// filters suppress A or AAAA answers of dual-stack names
+	filters []*answerFilter
+
+	// order is the sort mode of the addresses in an answer, empty keeps the hosts order
+	order string
+
+	// responseCache is the maximum number of cached responses, 0 disables the response cache
+	responseCache int
+
+	// negativeCache is the maximum number of cached missing names, 0 disables the negative cache
+	negativeCache int
+
+	// selector skips the hosts lines whose tags don't match, empty selects all lines
+	selector selector
+
+	// vars are substituted for the ${name} variables of the hosts lines
+	vars map[string]string
+
+	// soa is the SOA of the origins, nil keeps answering SERVFAIL instead of NXDOMAIN
+	soa *soaOptions
+
+	// dns64 synthesizes AAAA records for names without native AAAA records, nil disables DNS64
+	dns64 *dns64
+
+	// ttlMin and ttlMax clamp the TTL of all records, 0 leaves the bound open
+	ttlMin uint32
+	ttlMax uint32
+
+	// ttlJitter is the maximum percentage the TTL of a response is randomly lowered by
+	ttlJitter uint32
+
+	// autoReverseZones derives the reverse zones of the PTR entries from the loaded hosts
+	autoReverseZones bool
+
+	// maxChangeRatio is the largest fraction of the records a reload may remove, 0 disables the guard
+	maxChangeRatio float64
+
+	// nsid is the server identifier returned to queries with the NSID option, empty disables NSID
+	nsid string
+
+	// ptrCanonical answers PTR queries with the first (canonical) host name of the address only
+	ptrCanonical bool
+
+	// anyCPU and anyOS are the fields of the HINFO record answering ANY queries
+	anyCPU string
+	anyOS  string
+}
+
+// zoneOptions overrides the options for the names below zone.
+type zoneOptions struct {
+	zone string
+
+	// ttl overrides the TTL, 0 keeps the global TTL
+	ttl uint32
+
+	// noReverse disables the PTR entries of names below zone
+	noReverse bool
+
+	// filters are applied in addition to the global filters
+	filters []*answerFilter
+
+	// soa makes zone an origin of its own with this SOA, nil uses the SOA of the origin
+	soa *soaOptions
+}
+
+// zoneOptions returns the overrides of the most specific zone containing name, nil if there is none.
+func (o *options) zoneOptions(name string) *zoneOptions {
+	var best *zoneOptions
+	for _, zo := range o.zones {
+		if dns.IsSubDomain(zo.zone, name) && (best == nil || len(zo.zone) > len(best.zone)) {
+			best = zo
+		}
+	}
+	return best
+}
+
+// ttlFor returns the TTL of the records of name.
+func (o *options) ttlFor(name string) uint32 {
+	if zo := o.zoneOptions(name); zo != nil && zo.ttl > 0 {
+		return o.clampTTL(zo.ttl)
+	}
+	return o.clampTTL(o.ttl)
+}
+
+// autoReverseFor reports whether PTR entries are generated for name.
+func (o *options) autoReverseFor(name string) bool {
+	if zo := o.zoneOptions(name); zo != nil && zo.noReverse {
+		return false
+	}
+	return o.autoReverse
+}
+
+// answersReverse reports whether the PTR query for qname is in the configured reverse ranges.
+func (o *options) answersReverse(qname string) bool {
+	if len(o.reverseNets) == 0 && len(o.reverseZones) == 0 {
+		return true
+	}
+	if plugin.Zones(o.reverseZones).Matches(qname) != "" {
+		return true
+	}
+	ip := parseIP(dnsutil.ExtractAddressFromReverse(qname))
+	if ip == nil {
+		return false
+	}
+	for _, n := range o.reverseNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func newOptions() *options {
 	return &options{
 		autoReverse: true,
 		ttl:         3600,
+		anyCPU:      "RFC8482",
 	}
 }
 
-// Map contains the IPv4/IPv6 and reverse mapping.
+// Map contains the IPv4/IPv6 and reverse mapping. Addresses are stored as 4 and 16 byte arrays
+// and the slices of a map share a single backing array per field, so large hosts data needs
+// neither an allocation per address nor per entry.
 type Map struct {
-	// Key for the list of literal IP addresses must be a FQDN lowercased host name.
-	name4 map[string][]net.IP
-	name6 map[string][]net.IP
+	// Key for the list of IP addresses must be a FQDN lowercased host name.
+	name4 map[string][][4]byte
+	name6 map[string][][16]byte
 
-	// Key for the list of host names must be a literal IP address
-	// including IPv6 address without zone identifier.
+	// Key for the list of host names is an IP address without zone identifier,
+	// the host names are shared with the keys of name4 and name6.
 	// We don't support old-classful IP address notation.
-	addr map[string][]string
+	addr4 map[[4]byte][]string
+	addr6 map[[16]byte][]string
+
+	// Key for the ALIAS target must be a FQDN lowercased host name, the target is
+	// a FQDN lowercased host name too.
+	alias map[string]string
+
+	// canary holds the percentage of clients that get a canary address of a name, canaryNames
+	// holds the names with canary addresses.
+	canary      map[canaryKey]uint8
+	canaryNames map[string]bool
+
+	// meta holds the comment tags of the lines of a name, e.g. its owner or ticket. Tag maps
+	// are shared between the names of a line and must not be modified.
+	meta map[string]map[string]string
+
+	// index lists the host names for the admin api
+	index recordIndex
+
+	// nextChange is the earliest time a parsed line starts or expires, zero if there is none
+	nextChange time.Time
 }
 
 func newMap() *Map {
 	return &Map{
-		name4: make(map[string][]net.IP),
-		name6: make(map[string][]net.IP),
-		addr:  make(map[string][]string),
+		name4: make(map[string][][4]byte),
+		name6: make(map[string][][16]byte),
+		addr4: make(map[[4]byte][]string),
+		addr6: make(map[[16]byte][]string),
+		alias: make(map[string]string),
+
+		canary:      make(map[canaryKey]uint8),
+		canaryNames: make(map[string]bool),
+		meta:        make(map[string]map[string]string),
 	}
 }
 
-// Len returns the total number of addresses in the hostmap, this includes V4/V6 and any reverse addresses.
+// Len returns the total number of addresses in the hostmap, this includes V4/V6, any reverse addresses and aliases.
 func (h *Map) Len() int {
 	l := 0
 	for _, v4 := range h.name4 {
@@ -72,158 +253,407 @@ func (h *Map) Len() int {
 	for _, v6 := range h.name6 {
 		l += len(v6)
 	}
-	for _, a := range h.addr {
+	for _, a := range h.addr4 {
+		l += len(a)
+	}
+	for _, a := range h.addr6 {
 		l += len(a)
 	}
-	return l
+	return l + len(h.alias)
 }
 
-// HostsFile contains known host entries.
-type HostsFile struct {
-	sync.RWMutex
+// compact moves the slices of the map into a single backing array per map, dropping the spare
+// capacity left by append. The slices are capped so they can't be appended to in place.
+func (h *Map) compact() {
+	compactSlices(h.name4)
+	compactSlices(h.name6)
+	compactSlices(h.addr4)
+	compactSlices(h.addr6)
+}
 
-	// list of zones we are authoritative for
-	Origins []string
+func compactSlices[K comparable, V any](m map[K][]V) {
+	n := 0
+	for _, v := range m {
+		n += len(v)
+	}
+	backing := make([]V, 0, n)
+	for k, v := range m {
+		start := len(backing)
+		backing = append(backing, v...)
+		m[k] = backing[start:len(backing):len(backing)]
+	}
+}
 
+// hostsSnapshot is an immutable view of the loaded hosts, updates replace the whole snapshot
+// so lookups never take a lock.
+type hostsSnapshot struct {
 	// hosts maps for lookups
 	hmap *Map
 
-	// inline saves the hosts file that is inlined in a Corefile.
+	// inline saves the hosts file that is inlined in a Corefile, merged with the inline file.
 	inline *Map
 
-	// version are only read and modified by a single goroutine
-	version int64
+	// revision is the etcd revision the loaded hosts were read at
+	revision int64
+	// digest identifies the content of the loaded hosts, reloads with the same digest are skipped
+	digest uint64
+	// data are the loaded hosts, only kept while lines start or expire later so they can be
+	// parsed again without reading the storage
+	data []byte
+
+	// answers caches the records built from the maps above
+	answers *answerCache
+
+	// responses caches packed responses, nil if response_cache is disabled
+	responses *responseCache
+	// misses caches the names that don't exist, nil if negative_cache is disabled
+	misses *negativeCache
+
+	// reverseZones are the reverse zones derived from the maps above with auto_reverse_zones
+	reverseZones []string
+}
+
+// HostsFile contains known host entries.
+type HostsFile struct {
+	// mu serializes the updates of snap, lookups only load snap
+	mu   sync.Mutex
+	snap atomic.Pointer[hostsSnapshot]
+
+	// list of zones we are authoritative for
+	Origins []string
+
+	// inlineLines are the hosts lines inlined in the Corefile.
+	inlineLines []string
+
+	// inlineFile is a local hosts file merged into inline, its mtime and size are only
+	// read and modified by a single goroutine to detect changes.
+	inlineFile  string
+	inlineMtime time.Time
+	inlineSize  int64
 
 	options *options
+
+	// key identifies the plugin instance across Corefile reloads, it is the block label of the
+	// metrics
+	key string
 }
 
-// readHosts determines if the cached data needs to be updated based on the size and modification time of the hostsfile.
-func (h *HostsFile) readHosts(hosts []byte, version int64) {
-	if h.version == version {
-		return
-	}
+func newHostsFile() *HostsFile {
+	h := &HostsFile{options: newOptions()}
+	h.snap.Store(&hostsSnapshot{hmap: newMap(), inline: newMap(), answers: &answerCache{}})
+	return h
+}
+
+// snapshot returns the currently loaded hosts.
+func (h *HostsFile) snapshot() *hostsSnapshot {
+	return h.snap.Load()
+}
 
-	h.RLock()
-	version = h.version
-	h.RUnlock()
+// update replaces the loaded hosts with a copy of the current snapshot modified by fn.
+func (h *HostsFile) update(fn func(s *hostsSnapshot)) *hostsSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	// if version not changed, skip reading
+	s := *h.snap.Load()
+	fn(&s)
+	if h.options.autoReverseZones {
+		s.reverseZones = reverseZonesOf(s.hmap, s.inline)
+	}
+	s.answers = &answerCache{}
+	s.responses = newResponseCache(h.options.responseCache)
+	s.misses = newNegativeCache(h.options.negativeCache)
+	h.snap.Store(&s)
+	return &s
+}
 
-	newMap := h.parse(bytes.NewReader(hosts))
+// readHosts parses hosts and replaces the cached data if the hosts changed, it returns the
+// previous and the new hosts map, both are nil if nothing was reloaded.
+// Unless force is set, hosts removing more than max_change_ratio of the records are refused.
+func (h *HostsFile) readHosts(hosts []byte, revision int64, force bool) (*Map, *Map) {
+	old := h.snapshot()
+
+	// if the hosts did not change, skip reading unless lines started or expired since
+	now := time.Now()
+	digest := hostsDigest(hosts)
+	unchanged := old.digest == digest
+	if unchanged && !old.hmap.outdated(now) {
+		return nil, nil
+	}
+
+	newMap := h.parse(hosts)
 	log.Debugf("Parsed hosts file into %d entries", newMap.Len())
+	// lines that started or expired are not changes of the data, so the guard only compares
+	// changed hosts with the previous hosts evaluated at the same time
+	if !force && !unchanged && h.guardRejects(old.evaluated(h, now), newMap, revision) {
+		return nil, nil
+	}
 
-	h.Lock()
-	h.hmap = newMap
 	// Update the data cache.
-	h.version = version
-	hostsEntries.WithLabelValues().Set(float64(h.inline.Len() + h.hmap.Len()))
-	h.Unlock()
+	s := h.update(func(s *hostsSnapshot) {
+		s.hmap = newMap
+		s.revision = revision
+		s.digest = digest
+		s.data = nil
+		if !newMap.nextChange.IsZero() {
+			s.data = hosts
+		}
+	})
+	hostsEntries.WithLabelValues(h.key).Set(float64(s.inline.Len() + s.hmap.Len()))
+	recordsLoaded.WithLabelValues(h.key).Set(float64(newMap.Len()))
+	observeStore(h.key, h.Origins, s)
+
+	return old.hmap, newMap
+}
+
+// evaluated returns the hosts map of s with the lines that started or expired at now applied.
+func (s *hostsSnapshot) evaluated(h *HostsFile, now time.Time) *Map {
+	if s.data == nil || !s.hmap.outdated(now) {
+		return s.hmap
+	}
+	return h.parse(s.data)
+}
+
+// hostsDigest returns a digest of hosts data, it is never 0 so it differs from the digest of an
+// empty snapshot.
+func hostsDigest(data []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(data)
+	if d := f.Sum64(); d != 0 {
+		return d
+	}
+	return 1
 }
 
 func (h *HostsFile) initInline(inline []string) {
+	h.inlineLines = inline
+	if h.inlineFile != "" {
+		h.readInlineFile()
+		return
+	}
 	if len(inline) == 0 {
 		return
 	}
 
-	h.inline = h.parse(strings.NewReader(strings.Join(inline, "\n")))
+	newMap := h.parse([]byte(strings.Join(inline, "\n")))
+	s := h.update(func(s *hostsSnapshot) { s.inline = newMap })
+	observeStore(h.key, h.Origins, s)
+}
+
+// readInlineFile parses the Corefile inline entries together with the inline file if the file
+// changed since it was last read, the previous entries are kept if the file can't be read.
+func (h *HostsFile) readInlineFile() {
+	stat, err := os.Stat(h.inlineFile)
+	if err != nil {
+		log.Warningf("failed to stat inline file [%s]: %s", h.inlineFile, err)
+		return
+	}
+	if stat.ModTime().Equal(h.inlineMtime) && stat.Size() == h.inlineSize {
+		return
+	}
+
+	data, err := os.ReadFile(h.inlineFile)
+	if err != nil {
+		log.Warningf("failed to read inline file [%s]: %s", h.inlineFile, err)
+		return
+	}
+
+	inline := strings.Join(h.inlineLines, "\n") + "\n"
+	newMap := h.parse(append([]byte(inline), data...))
+	log.Debugf("Parsed inline file into %d entries", newMap.Len())
+
+	s := h.update(func(s *hostsSnapshot) { s.inline = newMap })
+	h.inlineMtime = stat.ModTime()
+	h.inlineSize = stat.Size()
+	hostsEntries.WithLabelValues(h.key).Set(float64(s.inline.Len() + s.hmap.Len()))
+	observeStore(h.key, h.Origins, s)
 }
 
 // Parse reads the hostsfile and populates the byName and addr maps.
-func (h *HostsFile) parse(r io.Reader) *Map {
+func (h *HostsFile) parse(hosts []byte) *Map {
 	hmap := newMap()
 
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := scanner.Bytes()
+	// names interns the host names of the lines, a name on several lines is normalized and
+	// stored once, it is empty for names outside of Origins.
+	names := make(map[string]string)
+	now := time.Now()
+	// canonical holds the ptr tags of the addresses
+	var canonical map[netip.Addr]string
+
+	for _, line := range hostsLines(hosts) {
+		line, undefined := h.options.expandVars(line)
+		if len(undefined) > 0 {
+			// a line with undefined variables is skipped rather than loaded half rendered
+			parseErrorCount.WithLabelValues(h.key).Inc()
+			continue
+		}
+		var comment []byte
 		if i := bytes.Index(line, []byte{'#'}); i >= 0 {
-			// Discard comments.
-			line = line[0:i]
+			// Discard comments, they only carry the tags of the line.
+			line, comment = line[0:i], line[i+1:]
 		}
 		f := bytes.Fields(line)
 		if len(f) < 2 {
+			if len(f) == 1 {
+				parseErrorCount.WithLabelValues(h.key).Inc()
+			}
 			continue
 		}
-		addr := parseIP(string(f[0]))
-		if addr == nil {
+		if len(h.options.selector) > 0 && !h.options.selector.matches(lineTags(comment)) {
 			continue
 		}
-
-		family := 0
-		if addr.To4() != nil {
-			family = 1
-		} else {
-			family = 2
+		active, next, err := lineActive(comment, now)
+		if err != nil {
+			parseErrorCount.WithLabelValues(h.key).Inc()
 		}
-
-		for i := 1; i < len(f); i++ {
-			name := plugin.Name(string(f[i])).Normalize()
+		if !next.IsZero() && (hmap.nextChange.IsZero() || next.Before(hmap.nextChange)) {
+			hmap.nextChange = next
+		}
+		if !active {
+			continue
+		}
+		if strings.EqualFold(string(f[0]), aliasKeyword) {
+			if len(f) != 3 {
+				parseErrorCount.WithLabelValues(h.key).Inc()
+				continue
+			}
+			name := plugin.Name(string(f[1])).Normalize()
 			if plugin.Zones(h.Origins).Matches(name) == "" {
 				// name is not in Origins
 				continue
 			}
-			switch family {
-			case 1:
-				hmap.name4[name] = append(hmap.name4[name], addr)
-			case 2:
-				hmap.name6[name] = append(hmap.name6[name], addr)
-			default:
-				continue
+			hmap.alias[name] = plugin.Name(string(f[2])).Normalize()
+			continue
+		}
+
+		addr, ok := parseAddr(string(f[0]))
+		if !ok {
+			parseErrorCount.WithLabelValues(h.key).Inc()
+			continue
+		}
+		canary, isCanary, err := lineCanary(comment)
+		if err != nil {
+			parseErrorCount.WithLabelValues(h.key).Inc()
+		}
+		var tags map[string]string
+		if bytes.IndexByte(comment, '=') >= 0 {
+			tags = lineTags(comment)
+		}
+		tagReverse, reverseSet, err := lineReverse(comment)
+		if err != nil {
+			parseErrorCount.WithLabelValues(h.key).Inc()
+		}
+		if ptr := linePTR(comment); ptr != "" {
+			if canonical == nil {
+				canonical = make(map[netip.Addr]string)
 			}
-			if !h.options.autoReverse {
+			canonical[addr] = ptr
+		}
+
+		for i := 1; i < len(f); i++ {
+			name, ok := names[string(f[i])]
+			if !ok {
+				name = plugin.Name(string(f[i])).Normalize()
+				if plugin.Zones(h.Origins).Matches(name) == "" {
+					// name is not in Origins
+					name = ""
+				}
+				names[string(f[i])] = name
+			}
+			if name == "" {
 				continue
 			}
-			hmap.addr[addr.String()] = append(hmap.addr[addr.String()], name)
+			if isCanary {
+				hmap.canary[canaryKey{name: name, addr: addr}] = canary
+				hmap.canaryNames[name] = true
+			}
+			if len(tags) > 0 {
+				hmap.meta[name] = mergeTags(hmap.meta[name], tags)
+			}
+			reverse := h.options.autoReverseFor(name)
+			if reverseSet {
+				reverse = tagReverse
+			}
+			if addr.Is4() {
+				a4 := addr.As4()
+				hmap.name4[name] = append(hmap.name4[name], a4)
+				if reverse {
+					hmap.addr4[a4] = append(hmap.addr4[a4], name)
+				}
+			} else {
+				a16 := addr.As16()
+				hmap.name6[name] = append(hmap.name6[name], a16)
+				if reverse {
+					hmap.addr6[a16] = append(hmap.addr6[a16], name)
+				}
+			}
 		}
 	}
 
+	hmap.setCanonical(canonical)
+	hmap.compact()
 	return hmap
 }
 
-// lookupStaticHost looks up the IP addresses for the given host from the hosts file.
-func (h *HostsFile) lookupStaticHost(m map[string][]net.IP, host string) []net.IP {
-	h.RLock()
-	defer h.RUnlock()
-
-	if len(m) == 0 {
+// asIPs4 converts the IPv4 addresses of a Map to newly allocated net.IPs.
+func asIPs4(addrs [][4]byte) []net.IP {
+	if len(addrs) == 0 {
 		return nil
 	}
+	buf := make([]byte, 0, net.IPv4len*len(addrs))
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		buf = append(buf, a[:]...)
+		ips[i] = buf[i*net.IPv4len : len(buf) : len(buf)]
+	}
+	return ips
+}
 
-	ips, ok := m[host]
-	if !ok {
+// asIPs6 converts the IPv6 addresses of a Map to newly allocated net.IPs.
+func asIPs6(addrs [][16]byte) []net.IP {
+	if len(addrs) == 0 {
 		return nil
 	}
-	ipsCp := make([]net.IP, len(ips))
-	copy(ipsCp, ips)
-	return ipsCp
+	buf := make([]byte, 0, net.IPv6len*len(addrs))
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		buf = append(buf, a[:]...)
+		ips[i] = buf[i*net.IPv6len : len(buf) : len(buf)]
+	}
+	return ips
 }
 
 // LookupStaticHostV4 looks up the IPv4 addresses for the given host from the hosts file.
 func (h *HostsFile) LookupStaticHostV4(host string) []net.IP {
 	host = strings.ToLower(host)
-	ip1 := h.lookupStaticHost(h.hmap.name4, host)
-	ip2 := h.lookupStaticHost(h.inline.name4, host)
+	s := h.snapshot()
+	ip1 := asIPs4(s.hmap.name4[host])
+	ip2 := asIPs4(s.inline.name4[host])
 	return append(ip1, ip2...)
 }
 
 // LookupStaticHostV6 looks up the IPv6 addresses for the given host from the hosts file.
 func (h *HostsFile) LookupStaticHostV6(host string) []net.IP {
 	host = strings.ToLower(host)
-	ip1 := h.lookupStaticHost(h.hmap.name6, host)
-	ip2 := h.lookupStaticHost(h.inline.name6, host)
+	s := h.snapshot()
+	ip1 := asIPs6(s.hmap.name6[host])
+	ip2 := asIPs6(s.inline.name6[host])
 	return append(ip1, ip2...)
 }
 
 // LookupStaticAddr looks up the hosts for the given address from the hosts file.
 func (h *HostsFile) LookupStaticAddr(addr string) []string {
-	addr = parseIP(addr).String()
-	if addr == "" {
+	a, ok := parseAddr(addr)
+	if !ok {
 		return nil
 	}
 
-	h.RLock()
-	defer h.RUnlock()
-	hosts1 := h.hmap.addr[addr]
-	hosts2 := h.inline.addr[addr]
+	s := h.snapshot()
+	var hosts1, hosts2 []string
+	if a.Is4() {
+		hosts1, hosts2 = s.hmap.addr4[a.As4()], s.inline.addr4[a.As4()]
+	} else {
+		hosts1, hosts2 = s.hmap.addr6[a.As16()], s.inline.addr6[a.As16()]
+	}
 
 	if len(hosts1) == 0 && len(hosts2) == 0 {
 		return nil
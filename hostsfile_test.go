@@ -0,0 +1,141 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name    string
+		hosts   string
+		vars    map[string]string
+		records []adminRecord
+		aliases map[string]string
+	}{
+		{
+			name:  "addresses",
+			hosts: "10.0.0.1 a.example.org b.example.org # comment\n::1 a.example.org\n\n# 10.0.0.2 a.example.org\n",
+			records: []adminRecord{
+				{Host: "a.example.org.", IPs: []string{"10.0.0.1", "::1"}},
+				{Host: "b.example.org.", IPs: []string{"10.0.0.1"}},
+			},
+		},
+		{
+			name:    "outside origins",
+			hosts:   "10.0.0.1 a.example.org a.example.net\n",
+			records: []adminRecord{{Host: "a.example.org.", IPs: []string{"10.0.0.1"}}},
+		},
+		{
+			name:    "invalid lines",
+			hosts:   "not-an-ip a.example.org\n10.0.0.1\n10.0.0.2 b.example.org\n",
+			records: []adminRecord{{Host: "b.example.org.", IPs: []string{"10.0.0.2"}}},
+		},
+		{
+			name:    "address zone",
+			hosts:   "fe80::1%eth0 a.example.org\n",
+			records: []adminRecord{{Host: "a.example.org.", IPs: []string{"fe80::1"}}},
+		},
+		{
+			name:  "tags",
+			hosts: "10.0.0.1 a.example.org # owner=team-a ticket=OPS-1\n10.0.0.2 a.example.org # env=prod\n",
+			records: []adminRecord{{Host: "a.example.org.", IPs: []string{"10.0.0.1", "10.0.0.2"},
+				Meta: map[string]string{"owner": "team-a", "ticket": "OPS-1", "env": "prod"}}},
+		},
+		{
+			name:    "alias",
+			hosts:   "ALIAS www.example.org lb.example.net\nalias api.example.org LB.example.net.\nALIAS bad.example.org\nALIAS www.example.net lb.example.net\n",
+			aliases: map[string]string{"www.example.org.": "lb.example.net.", "api.example.org.": "lb.example.net."},
+		},
+		{
+			name:    "vars",
+			hosts:   "${net}.1 a.example.org # owner=${team}\n${missing}.2 b.example.org\n",
+			vars:    map[string]string{"net": "10.0.0", "team": "team-a"},
+			records: []adminRecord{{Host: "a.example.org.", IPs: []string{"10.0.0.1"}, Meta: map[string]string{"owner": "team-a"}}},
+		},
+		{
+			name: "expiry",
+			hosts: "10.0.0.1 a.example.org # expires=" + past + "\n10.0.0.2 b.example.org # starts=" + future + "\n" +
+				"10.0.0.3 c.example.org # expires=" + future + "\n10.0.0.4 d.example.org # starts=" + past + " expires=" + future + "\n" +
+				"10.0.0.5 e.example.org # expires=tomorrow\n",
+			records: []adminRecord{
+				{Host: "c.example.org.", IPs: []string{"10.0.0.3"}, Meta: map[string]string{"expires": future}},
+				{Host: "d.example.org.", IPs: []string{"10.0.0.4"}, Meta: map[string]string{"starts": past, "expires": future}},
+				{Host: "e.example.org.", IPs: []string{"10.0.0.5"}, Meta: map[string]string{"expires": "tomorrow"}},
+			},
+		},
+		{
+			name:  "long line",
+			hosts: "10.0.0.1 a.example.org # " + strings.Repeat("x", 100000) + "\n10.0.0.2 b.example.org\n",
+			records: []adminRecord{
+				{Host: "a.example.org.", IPs: []string{"10.0.0.1"}},
+				{Host: "b.example.org.", IPs: []string{"10.0.0.2"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHostsFile()
+			h.Origins = []string{"example.org."}
+			h.options.vars = tt.vars
+
+			m := h.parse([]byte(tt.hosts))
+			if records, _ := m.records(0, -1); len(records) > 0 || len(tt.records) > 0 {
+				if !reflect.DeepEqual(records, tt.records) {
+					t.Errorf("records = %+v, want %+v", records, tt.records)
+				}
+			}
+			if len(m.alias) > 0 || len(tt.aliases) > 0 {
+				if !reflect.DeepEqual(m.alias, tt.aliases) {
+					t.Errorf("aliases = %v, want %v", m.alias, tt.aliases)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkHosts returns hosts data with names host names, every name has an IPv4 address and
+// every fourth name an IPv6 address as well.
+func benchmarkHosts(names int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < names; i++ {
+		fmt.Fprintf(&buf, "10.%d.%d.%d host%d.example.com\n", i>>16&0xff, i>>8&0xff, i&0xff, i)
+		if i%4 == 0 {
+			fmt.Fprintf(&buf, "fd00::%x:%x host%d.example.com\n", i>>16, i&0xffff, i)
+		}
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkParse parses 1M host names with 1.25M addresses and auto reverse on, heap-MiB is the
+// heap in use after a GC while only the parsed map is kept.
+func BenchmarkParse(b *testing.B) {
+	hosts := benchmarkHosts(1000000)
+	h := newHostsFile()
+	h.Origins = []string{"."}
+	h.options.autoReverse = true
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var m *Map
+	for i := 0; i < b.N; i++ {
+		m = h.parse(hosts)
+	}
+	b.StopTimer()
+
+	hosts = nil
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	b.ReportMetric(float64(ms.HeapAlloc)/(1<<20), "heap-MiB")
+	runtime.KeepAlive(m)
+}
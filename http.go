@@ -0,0 +1,125 @@
+package etcdhosts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// defaultHTTPInterval is the interval the hosts url is fetched at if the backend sets none
+const defaultHTTPInterval = 30 * time.Second
+
+func init() { registerBackend("http", newHTTPStorage) }
+
+// httpStorage periodically fetches the hosts data from an HTTP(S) url with conditional requests,
+// the revision is a hash of the data so it only changes with the data.
+type httpStorage struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	sync.Mutex
+	etag         string
+	lastModified string
+	data         []byte
+	revision     int64
+}
+
+func newHTTPStorage(h *EtcdHosts, args []string) (storage, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("the http backend needs a url and an optional interval")
+	}
+	u, err := url.ParseRequestURI(args[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid url '%s'", args[0])
+	}
+	interval := defaultHTTPInterval
+	if len(args) == 2 {
+		interval, err = time.ParseDuration(args[1])
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid interval '%s'", args[1])
+		}
+	}
+	return &httpStorage{url: args[0], interval: interval, client: &http.Client{}}, nil
+}
+
+func (s *httpStorage) load(ctx context.Context) ([]byte, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.data != nil {
+		if s.etag != "" {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+		if s.lastModified != "" {
+			req.Header.Set("If-Modified-Since", s.lastModified)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && s.data != nil:
+		return s.data, s.revision, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.data, s.revision = data, hashRevision(data)
+	s.etag, s.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	return s.data, s.revision, nil
+}
+
+// watch asks for a reload every interval, unchanged data is answered with 304 Not Modified.
+func (s *httpStorage) watch(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		tick := time.NewTicker(s.interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (s *httpStorage) String() string { return s.url }
+
+// hashRevision returns a positive revision derived from data.
+func hashRevision(data []byte) int64 {
+	f := fnv.New64a()
+	f.Write(data)
+	if r := int64(f.Sum64() & math.MaxInt64); r != 0 {
+		return r
+	}
+	return 1
+}
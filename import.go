@@ -0,0 +1,77 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// zoneImport holds the records of a BIND zone file that can be written as hosts lines.
+type zoneImport struct {
+	// ips are the A and AAAA addresses of every host name in Origins
+	ips map[string][]string
+	// skipped is the number of records that can't be represented
+	skipped int
+	// ttls are the host names with records whose TTL differs from the TTL the plugin serves them
+	// with, hosts lines don't carry a TTL
+	ttls []string
+}
+
+// parseZone reads a BIND zone file, records without a TTL and $TTL get the ttl property as
+// their TTL.
+func (h *HostsFile) parseZone(r io.Reader, origin string) (*zoneImport, error) {
+	zi := &zoneImport{ips: make(map[string][]string)}
+	ttls := make(map[string]bool)
+
+	zp := dns.NewZoneParser(r, dns.Fqdn(origin), "")
+	zp.SetDefaultTTL(h.options.ttl)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := plugin.Name(rr.Header().Name).Normalize()
+		if plugin.Zones(h.Origins).Matches(name) == "" {
+			zi.skipped++
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			zi.ips[name] = append(zi.ips[name], rr.A.String())
+		case *dns.AAAA:
+			zi.ips[name] = append(zi.ips[name], rr.AAAA.String())
+		default:
+			zi.skipped++
+			continue
+		}
+		if rr.Header().Ttl != h.options.ttlFor(name) && !ttls[name] {
+			ttls[name] = true
+			zi.ttls = append(zi.ttls, name)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(zi.ttls)
+	return zi, nil
+}
+
+// importHosts replaces the addresses and ALIAS lines of every host name in ips in a single pass,
+// other host names are kept.
+func importHosts(hosts []byte, ips map[string][]string) []byte {
+	remove := func(name string) bool {
+		_, ok := ips[name]
+		return ok
+	}
+	buf := bytes.NewBuffer(removeAliases(removeHosts(hosts, remove), remove))
+
+	names := make([]string, 0, len(ips))
+	for name := range ips {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeTaggedHost(buf, name, ips[name], nil)
+	}
+	return buf.Bytes()
+}
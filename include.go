@@ -0,0 +1,74 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// includeDirective starts a hosts line that is replaced with the hosts data of another etcd key.
+const includeDirective = "#include"
+
+// includeKey returns the key of an #include line.
+func includeKey(line []byte) (string, bool) {
+	f := bytes.Fields(line)
+	if len(f) != 2 || string(f[0]) != includeDirective {
+		return "", false
+	}
+	return string(f[1]), true
+}
+
+// includeResolver expands the #include lines of hosts data, get returns the data of a key, nil
+// data if the key does not exist.
+type includeResolver struct {
+	get func(key string) ([]byte, error)
+
+	// keys are the included keys
+	keys []string
+}
+
+// resolve returns hosts with every #include line replaced by the resolved data of the included
+// key, key is the key hosts was read from. A key included several times is only expanded once.
+func (r *includeResolver) resolve(key string, hosts []byte) ([]byte, error) {
+	if !bytes.Contains(hosts, []byte(includeDirective)) {
+		return hosts, nil
+	}
+	return r.expand(hosts, []string{key}, make(map[string]bool))
+}
+
+func (r *includeResolver) expand(hosts []byte, stack []string, seen map[string]bool) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, line := range hostsLines(hosts) {
+		key, ok := includeKey(line)
+		if !ok {
+			buf.Write(line)
+			buf.WriteByte('\n')
+			continue
+		}
+		for _, k := range stack {
+			if k == key {
+				return nil, fmt.Errorf("include cycle %s -> %s", strings.Join(stack, " -> "), key)
+			}
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		data, err := r.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			return nil, fmt.Errorf("included key [%s] does not exist", key)
+		}
+		r.keys = append(r.keys, key)
+
+		data, err = r.expand(data, append(stack[:len(stack):len(stack)], key), seen)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
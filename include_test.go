@@ -0,0 +1,101 @@
+package etcdhosts
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIncludeResolve(t *testing.T) {
+	errGet := errors.New("etcd unavailable")
+
+	tests := []struct {
+		name  string
+		hosts string
+		keys  map[string]string
+		want  string
+		err   string
+		// included are the keys the resolver reports as included
+		included []string
+	}{
+		{
+			name:  "no include",
+			hosts: "10.0.0.1 a.example.org\n",
+			want:  "10.0.0.1 a.example.org\n",
+		},
+		{
+			name:     "include",
+			hosts:    "10.0.0.1 a.example.org\n#include /shared\n10.0.0.3 c.example.org\n",
+			keys:     map[string]string{"/shared": "10.0.0.2 b.example.org\n"},
+			want:     "10.0.0.1 a.example.org\n10.0.0.2 b.example.org\n10.0.0.3 c.example.org\n",
+			included: []string{"/shared"},
+		},
+		{
+			name:     "nested",
+			hosts:    "#include /a\n",
+			keys:     map[string]string{"/a": "10.0.0.1 a.example.org\n#include /b\n", "/b": "10.0.0.2 b.example.org"},
+			want:     "10.0.0.1 a.example.org\n10.0.0.2 b.example.org\n",
+			included: []string{"/a", "/b"},
+		},
+		{
+			name:     "included twice",
+			hosts:    "#include /a\n#include /b\n",
+			keys:     map[string]string{"/a": "#include /b\n", "/b": "10.0.0.2 b.example.org\n"},
+			want:     "10.0.0.2 b.example.org\n",
+			included: []string{"/a", "/b"},
+		},
+		{
+			name:  "commented include",
+			hosts: "# include /a\n#include\n",
+			want:  "# include /a\n#include\n",
+		},
+		{
+			name:  "missing key",
+			hosts: "#include /missing\n",
+			err:   "included key [/missing] does not exist",
+		},
+		{
+			name:  "cycle",
+			hosts: "#include /a\n",
+			keys:  map[string]string{"/a": "#include /b\n", "/b": "#include /hosts\n"},
+			err:   "include cycle /hosts -> /a -> /b -> /hosts",
+		},
+		{
+			name:  "get error",
+			hosts: "#include /error\n",
+			err:   errGet.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &includeResolver{get: func(key string) ([]byte, error) {
+				if key == "/error" {
+					return nil, errGet
+				}
+				if v, ok := tt.keys[key]; ok {
+					return []byte(v), nil
+				}
+				return nil, nil
+			}}
+
+			got, err := r.resolve("/hosts", []byte(tt.hosts))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("hosts = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(r.keys, tt.included) {
+				t.Errorf("included keys = %v, want %v", r.keys, tt.included)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package etcdhosts
+
+import (
+	"bytes"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+const (
+	// mergeOverride hides the addresses of a host name in all earlier sources once a later
+	// source defines it
+	mergeOverride = "override"
+	// mergeUnion serves the addresses of a host name from all sources
+	mergeUnion = "union"
+)
+
+// mergeHosts merges the hosts data of several sources into one, later sources take precedence
+// over earlier ones according to policy.
+func mergeHosts(sources [][]byte, policy string) []byte {
+	if len(sources) == 1 {
+		return sources[0]
+	}
+
+	merged := make([][]byte, len(sources))
+	defined := make(map[string]bool)
+	for i := len(sources) - 1; i >= 0; i-- {
+		merged[i] = sources[i]
+		if policy != mergeOverride {
+			continue
+		}
+		if i < len(sources)-1 {
+			merged[i] = removeHosts(sources[i], func(name string) bool { return defined[name] })
+		}
+		for _, name := range hostNames(sources[i]) {
+			defined[name] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, m := range merged {
+		buf.Write(m)
+		if len(m) > 0 && m[len(m)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// hostNames returns the normalized host names of the address lines of hosts.
+func hostNames(hosts []byte) []string {
+	var names []string
+	for _, line := range hostsLines(hosts) {
+		if i := bytes.Index(line, []byte{'#'}); i >= 0 {
+			line = line[0:i]
+		}
+		f := bytes.Fields(line)
+		if len(f) < 2 || parseIP(string(f[0])) == nil {
+			continue
+		}
+		for _, n := range f[1:] {
+			names = append(names, plugin.Name(string(n)).Normalize())
+		}
+	}
+	return names
+}
@@ -3,16 +3,183 @@ package etcdhosts
 import (
 	"github.com/coredns/coredns/plugin"
 
+	"github.com/miekg/dns"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
-	// hostsEntries is the combined number of entries in hosts and Corefile.
+	// hostsEntries is the combined number of entries in hosts and Corefile by block.
 	hostsEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "etcdhosts",
 		Name:      "entries",
-		Help:      "The combined number of entries in etcdhosts and Corefile.",
-	}, []string{})
+		Help:      "The combined number of entries in etcdhosts and Corefile by block.",
+	}, []string{"block"})
+
+	// queryCount is the number of queries answered by etcdhosts by zone, query type and rcode.
+	queryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "queries_total",
+		Help:      "Counter of queries answered by etcdhosts by zone, query type and rcode.",
+	}, []string{"zone", "type", "rcode"})
+
+	// answerRecords is the number of answer records in every response by zone and query type.
+	answerRecords = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "answer_records",
+		Help:      "Histogram of the number of answer records in etcdhosts responses by zone and query type.",
+		Buckets:   []float64{0, 1, 2, 4, 8, 16, 32, 64},
+	}, []string{"zone", "type"})
+
+	// reloadCount is the number of successful reads of the hosts key from etcd by block.
+	reloadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "reloads_total",
+		Help:      "Counter of successful hosts reloads from etcd by block.",
+	}, []string{"block"})
+
+	// reloadFailureCount is the number of failed reads of the hosts key from etcd, by block.
+	reloadFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "reload_failures_total",
+		Help:      "Counter of failed hosts reloads from etcd by block.",
+	}, []string{"block"})
+
+	// parseErrorCount is the number of hosts lines skipped because they could not be parsed, by block.
+	parseErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "parse_errors_total",
+		Help:      "Counter of hosts lines skipped because they could not be parsed, by block.",
+	}, []string{"block"})
+
+	// recordsLoaded is the number of entries loaded from etcd by the last reload of a block.
+	recordsLoaded = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "records_loaded",
+		Help:      "The number of entries loaded from etcd by the last reload, by block.",
+	}, []string{"block"})
+
+	// refusedReloadCount is the number of reloads refused because they removed too many records, by block.
+	refusedReloadCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "refused_reloads_total",
+		Help:      "Counter of hosts reloads refused because they removed more than max_change_ratio of the records, by block.",
+	}, []string{"block"})
+
+	// storeRecords is the number of loaded records by block, origin and type, reverse entries are
+	// counted in the "reverse" origin.
+	storeRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "store_records",
+		Help:      "The number of records loaded from etcd and the Corefile by block, origin and type.",
+	}, []string{"block", "origin", "type"})
+
+	// watchUp is 1 while the etcd watch of a key is established, by block and key.
+	watchUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "watch_up",
+		Help:      "Whether the etcd watch of the key is established, by block.",
+	}, []string{"block", "key"})
+
+	// watchRevisionGap is the number of etcd revisions the watch of a key is behind the cluster, by
+	// block and key.
+	watchRevisionGap = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "watch_revision_gap",
+		Help:      "The number of etcd revisions the watch of the key is behind the cluster, by block.",
+	}, []string{"block", "key"})
+
+	// watchIdleSeconds is the time since the last response of the etcd watch of a key, by block and key.
+	watchIdleSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "watch_idle_seconds",
+		Help:      "Seconds since the last event or progress notification of the etcd watch of the key, by block.",
+	}, []string{"block", "key"})
+
+	// signatureFailureCount is the number of etcd keys rejected because of a missing or invalid signature, by block.
+	signatureFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "signature_failures_total",
+		Help:      "Counter of etcd keys rejected because of a missing or invalid signature, by block.",
+	}, []string{"block"})
+
+	// rateLimitedCount is the number of queries over the rate limit of their client by action.
+	rateLimitedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "etcdhosts",
+		Name:      "ratelimited_total",
+		Help:      "Counter of queries over the rate limit of their client by action.",
+	}, []string{"action"})
 )
+
+// observeStore updates the store composition metrics of block from the loaded hosts of s.
+func observeStore(block string, origins []string, s *hostsSnapshot) {
+	counts := make(map[[2]string]int)
+	for _, o := range origins {
+		for _, typ := range []string{"A", "AAAA", "ALIAS"} {
+			counts[[2]string{o, typ}] = 0
+		}
+	}
+	counts[[2]string{"reverse", "PTR"}] = 0
+
+	for _, m := range []*Map{s.hmap, s.inline} {
+		for name, addrs := range m.name4 {
+			counts[[2]string{plugin.Zones(origins).Matches(name), "A"}] += len(addrs)
+		}
+		for name, addrs := range m.name6 {
+			counts[[2]string{plugin.Zones(origins).Matches(name), "AAAA"}] += len(addrs)
+		}
+		for name := range m.alias {
+			counts[[2]string{plugin.Zones(origins).Matches(name), "ALIAS"}]++
+		}
+		for _, names := range m.addr4 {
+			counts[[2]string{"reverse", "PTR"}] += len(names)
+		}
+		for _, names := range m.addr6 {
+			counts[[2]string{"reverse", "PTR"}] += len(names)
+		}
+	}
+
+	for k, n := range counts {
+		storeRecords.WithLabelValues(block, k[0], k[1]).Set(float64(n))
+	}
+}
+
+// forgetBlock removes the metrics of block once its plugin instance is gone.
+func forgetBlock(block string) {
+	for _, m := range []*prometheus.MetricVec{hostsEntries.MetricVec, reloadCount.MetricVec, recordsLoaded.MetricVec, storeRecords.MetricVec,
+		reloadFailureCount.MetricVec, parseErrorCount.MetricVec, refusedReloadCount.MetricVec, signatureFailureCount.MetricVec,
+		watchUp.MetricVec, watchRevisionGap.MetricVec, watchIdleSeconds.MetricVec} {
+		m.DeletePartialMatch(prometheus.Labels{"block": block})
+	}
+}
+
+// observeQuery updates the query metrics, the query type label is limited to the types etcdhosts
+// serves and PTR queries outside Origins are counted in the "reverse" zone to bound cardinality.
+func observeQuery(zone string, qtype uint16, rcode, answers int) {
+	if zone == "" {
+		zone = "reverse"
+	}
+	typ := "other"
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypePTR:
+		typ = dns.TypeToString[qtype]
+	}
+
+	queryCount.WithLabelValues(zone, typ, dns.RcodeToString[rcode]).Inc()
+	answerRecords.WithLabelValues(zone, typ).Observe(float64(answers))
+}
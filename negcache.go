@@ -0,0 +1,44 @@
+package etcdhosts
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// defaultNegativeCacheSize is the number of names cached if negative_cache has no size
+const defaultNegativeCacheSize = 10000
+
+// negativeCache holds the names of a snapshot that don't exist, it is dropped together with the
+// snapshot so every reload starts with an empty cache. Once size names are cached no more names
+// are added.
+type negativeCache struct {
+	sync.Map
+	size int64
+	n    atomic.Int64
+}
+
+func newNegativeCache(size int) *negativeCache {
+	if size <= 0 {
+		return nil
+	}
+	return &negativeCache{size: int64(size)}
+}
+
+// has reports whether name is known not to exist, it is false if the cache is disabled.
+func (c *negativeCache) has(name string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.Load(name)
+	return ok
+}
+
+// add records that name does not exist.
+func (c *negativeCache) add(name string) {
+	if c == nil || c.n.Load() >= c.size {
+		return
+	}
+	if _, loaded := c.LoadOrStore(name, struct{}{}); !loaded {
+		c.n.Add(1)
+	}
+}
@@ -0,0 +1,42 @@
+package etcdhosts
+
+import (
+	"encoding/hex"
+
+	"github.com/miekg/dns"
+)
+
+// wantsNSID reports whether the query r asks for the server identifier (RFC 5001).
+func wantsNSID(r *dns.Msg) bool {
+	o := r.IsEdns0()
+	if o == nil {
+		return false
+	}
+	for _, opt := range o.Option {
+		if opt.Option() == dns.EDNS0NSID {
+			return true
+		}
+	}
+	return false
+}
+
+// setNSID adds the configured server identifier to the OPT record of the response m if the query r
+// asks for it, m must already mirror the OPT record of r.
+func (h *EtcdHosts) setNSID(r, m *dns.Msg) {
+	if h.options.nsid == "" || !wantsNSID(r) {
+		return
+	}
+	o := m.IsEdns0()
+	if o == nil {
+		return
+	}
+	nsid := hex.EncodeToString([]byte(h.options.nsid))
+	for _, opt := range o.Option {
+		// the OPT record of the response may carry the empty NSID option of the query
+		if e, ok := opt.(*dns.EDNS0_NSID); ok {
+			e.Nsid = nsid
+			return
+		}
+	}
+	o.Option = append(o.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: nsid})
+}
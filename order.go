@@ -0,0 +1,115 @@
+package etcdhosts
+
+import (
+	"net"
+	"sort"
+)
+
+// orderRFC6724 sorts the addresses of an answer with the RFC 6724 destination address selection
+// rules, using the client address as the source address.
+const orderRFC6724 = "rfc6724"
+
+// policyEntry is an entry of the RFC 6724 default policy table.
+type policyEntry struct {
+	prefix     *net.IPNet
+	precedence uint8
+}
+
+// rfc6724Policy is the RFC 6724 section 2.1 default policy table, longest prefixes first.
+var rfc6724Policy = []policyEntry{
+	{mustCIDR("::1/128"), 50},
+	{mustCIDR("::ffff:0:0/96"), 35},
+	{mustCIDR("::/96"), 1},
+	{mustCIDR("2001::/32"), 5},
+	{mustCIDR("2002::/16"), 30},
+	{mustCIDR("3ffe::/16"), 1},
+	{mustCIDR("fec0::/10"), 1},
+	{mustCIDR("fc00::/7"), 3},
+	{mustCIDR("::/0"), 40},
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// precedence returns the precedence of ip in the default policy table.
+func precedence(ip net.IP) uint8 {
+	ip16 := ip.To16()
+	for _, p := range rfc6724Policy {
+		if p.prefix.Contains(ip16) {
+			return p.precedence
+		}
+	}
+	return 0
+}
+
+// scope returns the RFC 6724 section 3.1 scope of ip, IPv4 addresses use the scopes of
+// section 3.2.
+func scope(ip net.IP) uint8 {
+	switch {
+	case ip.IsLoopback(), ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return 0x2
+	case ip.To4() == nil && ip[0] == 0xfe && ip[1]&0xc0 == 0xc0:
+		// deprecated IPv6 site local
+		return 0x5
+	case ip.IsInterfaceLocalMulticast():
+		return 0x1
+	}
+	return 0xe
+}
+
+// commonPrefixLen returns the length of the common prefix of a and b, only addresses of the same
+// family are compared and IPv6 addresses only up to their 64 bit prefix.
+func commonPrefixLen(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		if a4 == nil || b4 == nil {
+			return 0
+		}
+		a, b = a4, b4
+	} else {
+		a, b = a.To16()[:8], b.To16()[:8]
+	}
+
+	l := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			l += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			l++
+			x <<= 1
+		}
+		break
+	}
+	return l
+}
+
+// sortRFC6724 sorts ips in place by the RFC 6724 rules relevant to an answer of a single family:
+// matching scope (rule 2), precedence (rule 6), smaller scope (rule 8) and the longest matching
+// prefix (rule 9). The order is left unchanged if client is nil.
+func sortRFC6724(ips []net.IP, client net.IP) {
+	if client == nil || len(ips) < 2 {
+		return
+	}
+	clientScope := scope(client)
+	sort.SliceStable(ips, func(i, j int) bool {
+		a, b := ips[i], ips[j]
+
+		if sa, sb := scope(a) == clientScope, scope(b) == clientScope; sa != sb {
+			return sa
+		}
+		if pa, pb := precedence(a), precedence(b); pa != pb {
+			return pa > pb
+		}
+		if sa, sb := scope(a), scope(b); sa != sb {
+			return sa < sb
+		}
+		return commonPrefixLen(a, client) > commonPrefixLen(b, client)
+	})
+}
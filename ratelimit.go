@@ -0,0 +1,181 @@
+package etcdhosts
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// rateLimitDrop drops queries over the limit without a response
+	rateLimitDrop = "drop"
+	// rateLimitTruncate answers UDP queries over the limit with an empty truncated response so
+	// the client retries over TCP, TCP queries over the limit are refused
+	rateLimitTruncate = "truncate"
+	// rateLimitRefuse answers queries over the limit with REFUSED
+	rateLimitRefuse = "refuse"
+
+	// rateLimitSweepInterval is how often the buckets of idle clients are removed
+	rateLimitSweepInterval = time.Minute
+)
+
+// bucket is the token bucket of a client network.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the queries per second of every client network with a token bucket, clients
+// are grouped by the prefix of their address.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	action string
+	// bits4 and bits6 are the prefix lengths client addresses are grouped by
+	bits4 int
+	bits6 int
+
+	mu        sync.Mutex
+	buckets   map[netip.Prefix]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int, action string) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		action:  action,
+		bits4:   32,
+		bits6:   128,
+		buckets: make(map[netip.Prefix]*bucket),
+	}
+}
+
+// allow takes a token from the bucket of the network of client, it is false if the bucket is
+// empty. Queries without a valid client address are always allowed.
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return true
+	}
+	addr = addr.Unmap()
+	bits := l.bits6
+	if addr.Is4() {
+		bits = l.bits4
+	}
+	network, _ := addr.Prefix(bits)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[network]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[network] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens earned since the last query of the bucket.
+func (l *rateLimiter) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+}
+
+// sweep removes the buckets that are full again, a new bucket starts full so forgetting them
+// doesn't change the limits.
+func (l *rateLimiter) sweep(now time.Time) {
+	for network, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, network)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimited handles a query over the rate limit of its client with the configured action.
+func (h *EtcdHosts) rateLimited(state request.Request) (int, error) {
+	rateLimitedCount.WithLabelValues(h.limiter.action).Inc()
+	h.debugQuery(state, "rate limited", nil)
+	switch {
+	case h.limiter.action == rateLimitDrop:
+		return dns.RcodeSuccess, nil
+	case h.limiter.action == rateLimitTruncate && state.Proto() == "udp":
+		m := new(dns.Msg)
+		m.SetReply(state.Req)
+		m.Truncated = true
+		state.SizeAndDo(m)
+		_ = state.W.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	}
+	return dns.RcodeRefused, nil
+}
+
+// parseRateLimit parses a `ratelimit RATE [BURST] [drop|truncate|refuse]` property, the burst
+// defaults to one second of queries and the action to refuse.
+func parseRateLimit(args []string) (*rateLimiter, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return nil, errors.New("ratelimit needs a rate, an optional burst and an optional action")
+	}
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("ratelimit needs a positive rate, got '%s'", args[0])
+	}
+	burst := int(math.Ceil(rate))
+	action := rateLimitRefuse
+	for _, arg := range args[1:] {
+		switch arg {
+		case rateLimitDrop, rateLimitTruncate, rateLimitRefuse:
+			action = arg
+			continue
+		}
+		if burst, err = strconv.Atoi(arg); err != nil || burst <= 0 {
+			return nil, fmt.Errorf("ratelimit needs a positive burst or an action, got '%s'", arg)
+		}
+	}
+	return newRateLimiter(rate, burst, action), nil
+}
+
+// parsePrefix parses the `ratelimit_prefix V4_LENGTH [V6_LENGTH]` property into the prefix lengths
+// of the limiter.
+func (l *rateLimiter) parsePrefix(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("ratelimit_prefix needs an IPv4 and an optional IPv6 prefix length")
+	}
+	for i, arg := range args {
+		bits, err := strconv.Atoi(arg)
+		if i == 0 && (err != nil || bits < 0 || bits > 32) {
+			return fmt.Errorf("invalid IPv4 prefix length '%s'", arg)
+		}
+		if i == 1 && (err != nil || bits < 0 || bits > 128) {
+			return fmt.Errorf("invalid IPv6 prefix length '%s'", arg)
+		}
+		if i == 0 {
+			l.bits4 = bits
+		} else {
+			l.bits6 = bits
+		}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package etcdhosts
+
+// Ready implements the ready.Readiness interface, etcdhosts is ready once the hosts were
+// loaded from etcd at least once so an empty zone is never served as ready, and stops
+// being ready when etcd was unreachable for longer than the stale threshold.
+func (h *EtcdHosts) Ready() bool {
+	return h.snapshot().revision != 0 && !h.stale()
+}
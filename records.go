@@ -0,0 +1,79 @@
+package etcdhosts
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// recordIndex holds the sorted host names of a map, it is built on first use so maps that are
+// never listed don't pay for it.
+type recordIndex struct {
+	once  sync.Once
+	names []string
+}
+
+// sortedNames returns the host names with addresses in the map, sorted.
+func (h *Map) sortedNames() []string {
+	h.index.once.Do(func() {
+		names := make([]string, 0, len(h.name4)+len(h.name6))
+		for name := range h.name4 {
+			names = append(names, name)
+		}
+		for name := range h.name6 {
+			if _, ok := h.name4[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		h.index.names = names
+	})
+	return h.index.names
+}
+
+// record returns the sorted addresses and the metadata of name, ok is false if name has no
+// addresses.
+func (h *Map) record(name string) (rec adminRecord, ok bool) {
+	v4, v6 := h.name4[name], h.name6[name]
+	if len(v4) == 0 && len(v6) == 0 {
+		return rec, false
+	}
+	rec = adminRecord{Host: name, IPs: make([]string, 0, len(v4)+len(v6)), Meta: h.meta[name]}
+	for _, addr := range v4 {
+		rec.IPs = append(rec.IPs, netip.AddrFrom4(addr).String())
+	}
+	for _, addr := range v6 {
+		rec.IPs = append(rec.IPs, netip.AddrFrom16(addr).String())
+	}
+	sort.Strings(rec.IPs)
+	return rec, true
+}
+
+// forEach calls fn with the records of the map sorted by host name until fn returns false.
+func (h *Map) forEach(fn func(rec adminRecord) bool) {
+	for _, name := range h.sortedNames() {
+		rec, _ := h.record(name)
+		if !fn(rec) {
+			return
+		}
+	}
+}
+
+// records returns at most limit records sorted by host name starting at offset, all records
+// after offset if limit is negative, and the total number of records.
+func (h *Map) records(offset, limit int) ([]adminRecord, int) {
+	names := h.sortedNames()
+	if offset > len(names) {
+		offset = len(names)
+	}
+	names = names[offset:]
+	if limit >= 0 && limit < len(names) {
+		names = names[:limit]
+	}
+	records := make([]adminRecord, 0, len(names))
+	for _, name := range names {
+		rec, _ := h.record(name)
+		records = append(records, rec)
+	}
+	return records, len(h.sortedNames())
+}
@@ -0,0 +1,156 @@
+package etcdhosts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// registrationTTL is the TTL of the lease the registration key is attached to, the key
+// disappears this long after the instance stopped renewing it
+const registrationTTL = 30
+
+// registration publishes the instance under an etcd prefix with a lease kept alive while the
+// instance runs, so the live DNS servers can be discovered from etcd.
+type registration struct {
+	h      *EtcdHosts
+	key    string
+	record registrationRecord
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// registrationRecord is the JSON value of a registration key.
+type registrationRecord struct {
+	Hostname string    `json:"hostname"`
+	Addr     string    `json:"addr"`
+	Zones    []string  `json:"zones"`
+	Started  time.Time `json:"started"`
+}
+
+// newRegistration registers the instance as PREFIX/HOSTNAME with addr, the first global unicast
+// address of the host is used if addr is empty.
+func newRegistration(h *EtcdHosts, prefix, addr string) (*registration, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		if addr, err = hostAddr(); err != nil {
+			return nil, err
+		}
+	}
+	return &registration{
+		h:   h,
+		key: path.Join(prefix, hostname),
+		record: registrationRecord{
+			Hostname: hostname,
+			Addr:     addr,
+			Zones:    h.Origins,
+		},
+	}, nil
+}
+
+// hostAddr returns the first global unicast address of the host, IPv4 addresses are preferred.
+func hostAddr() (string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	var v6 string
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || !n.IP.IsGlobalUnicast() {
+			continue
+		}
+		if n.IP.To4() != nil {
+			return n.IP.String(), nil
+		}
+		if v6 == "" {
+			v6 = n.IP.String()
+		}
+	}
+	if v6 == "" {
+		return "", errors.New("no global unicast address found")
+	}
+	return v6, nil
+}
+
+// OnStartup starts registering the instance.
+func (r *registration) OnStartup() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.record.Started = time.Now().UTC()
+	go func() {
+		defer close(r.done)
+		for {
+			if err := r.register(ctx); err != nil {
+				log.Errorf("failed to register instance as [%s]: %s", r.key, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return nil
+}
+
+// OnShutdown stops registering the instance, the key is removed together with the revoked lease.
+func (r *registration) OnShutdown() error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	<-r.done
+	return nil
+}
+
+// register writes the registration key with a new lease and keeps the lease alive until ctx is
+// done or the keep alive fails, the lease is revoked on return.
+func (r *registration) register(ctx context.Context) error {
+	client := r.h.client()
+	value, err := json.Marshal(r.record)
+	if err != nil {
+		return err
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, r.h.etcdConfig.Timeout)
+	lease, err := client.Grant(tctx, registrationTTL)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		rctx, cancel := context.WithTimeout(context.Background(), r.h.etcdConfig.Timeout)
+		defer cancel()
+		_, _ = client.Revoke(rctx, lease.ID)
+	}()
+
+	tctx, cancel = context.WithTimeout(ctx, r.h.etcdConfig.Timeout)
+	_, err = client.Put(tctx, r.key, string(value), clientv3.WithLease(lease.ID))
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	keepAlive, err := client.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return err
+	}
+	log.Infof("registered instance as [%s]", r.key)
+	for range keepAlive {
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.New("lease keep alive stopped")
+}
@@ -0,0 +1,196 @@
+package etcdhosts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// registry keeps state across plugin instances: instances configured for the same etcd cluster
+// share a single client, and the instance created by a Corefile reload takes over the loaded
+// hosts of the instance it replaces instead of starting with an empty store.
+var registry = struct {
+	sync.Mutex
+	clients map[string]*sharedClient
+	stores  map[string]storeState
+}{
+	clients: make(map[string]*sharedClient),
+	stores:  make(map[string]storeState),
+}
+
+// sharedClient is an etcd client used by one or more plugin instances, the client is replaced
+// when the credentials it was created with change.
+type sharedClient struct {
+	client atomic.Pointer[clientv3.Client]
+	refs   int
+
+	// userName and password are the credentials of client
+	userName string
+	password string
+}
+
+// storeState is the hosts map last loaded by a plugin instance.
+type storeState struct {
+	hmap     *Map
+	revision int64
+	digest   uint64
+	data     []byte
+	// fingerprint identifies the settings the map was parsed with
+	fingerprint string
+}
+
+// forceStartRetryInterval is how often a force_start instance retries connecting to etcd and
+// loading the hosts until it succeeds
+const forceStartRetryInterval = 5 * time.Second
+
+// acquireClient returns the client registered under key, creating it from c if there is none.
+// With ForceStart a client that can't authenticate yet is replaced by an unauthenticated client
+// until connect succeeds in the background.
+func acquireClient(key string, c *EtcdConfig) (*sharedClient, error) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if sc, ok := registry.clients[key]; ok {
+		sc.refs++
+		return sc, nil
+	}
+
+	sc := &sharedClient{refs: 1, userName: c.UserName, password: c.Password}
+	cli, err := c.NewClient()
+	if err != nil {
+		if !c.ForceStart {
+			return nil, err
+		}
+		log.Warningf("failed to create etcd client, connecting in the background: %s", err)
+		if cli, err = c.newUnauthenticatedClient(); err != nil {
+			return nil, err
+		}
+		sc.userName, sc.password = "", ""
+		go connectClient(key, c)
+	}
+	sc.client.Store(cli)
+	registry.clients[key] = sc
+	return sc, nil
+}
+
+// connectClient renews the client registered under key with the credentials of c until it
+// succeeds or the client is released. With discovery the endpoints are discovered again first.
+func connectClient(key string, c *EtcdConfig) {
+	for {
+		time.Sleep(forceStartRetryInterval)
+		registry.Lock()
+		_, ok := registry.clients[key]
+		registry.Unlock()
+		if !ok {
+			return
+		}
+		cfg := c
+		if c.Discovery != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+			endpoints, err := c.discoverEndpoints(ctx)
+			cancel()
+			if err != nil {
+				log.Warningf("failed to discover etcd endpoints: %s", err)
+				continue
+			}
+			discovered := *c
+			discovered.Endpoints = endpoints
+			cfg = &discovered
+		}
+		if _, err := renewClient(key, cfg, c.UserName, c.Password); err != nil {
+			log.Warningf("failed to create etcd client: %s", err)
+			continue
+		}
+		log.Infof("connected to etcd")
+		return
+	}
+}
+
+// renewClient replaces the client registered under key with a client that authenticates with
+// userName and password unless it already does, it reports whether the client was replaced.
+// The previous client is closed after the etcd timeout so requests in flight can finish.
+func renewClient(key string, c *EtcdConfig, userName, password string) (bool, error) {
+	registry.Lock()
+	sc, ok := registry.clients[key]
+	current := ok && sc.userName == userName && sc.password == password
+	registry.Unlock()
+	if !ok || current {
+		return false, nil
+	}
+
+	renewed := *c
+	renewed.UserName, renewed.Password = userName, password
+	cli, err := renewed.NewClient()
+	if err != nil {
+		return false, err
+	}
+
+	registry.Lock()
+	if registry.clients[key] != sc || sc.userName == userName && sc.password == password {
+		// released or renewed in the meantime
+		registry.Unlock()
+		return false, cli.Close()
+	}
+	sc.userName, sc.password = userName, password
+	old := sc.client.Swap(cli)
+	registry.Unlock()
+
+	time.AfterFunc(c.Timeout, func() { _ = old.Close() })
+	return true, nil
+}
+
+// releaseClient drops a reference to the client registered under key, the client is closed
+// once it is no longer used.
+func releaseClient(key string) error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	sc, ok := registry.clients[key]
+	if !ok {
+		return nil
+	}
+	sc.refs--
+	if sc.refs > 0 {
+		return nil
+	}
+	delete(registry.clients, key)
+	return sc.client.Load().Close()
+}
+
+// saveStore registers the hosts map loaded by the instance identified by key.
+func saveStore(key string, st storeState) {
+	registry.Lock()
+	registry.stores[key] = st
+	registry.Unlock()
+}
+
+// loadStore returns the hosts map last loaded by the instance identified by key.
+func loadStore(key string) (storeState, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	st, ok := registry.stores[key]
+	return st, ok
+}
+
+// dropStore forgets the hosts map of the instance identified by key.
+func dropStore(key string) {
+	registry.Lock()
+	delete(registry.stores, key)
+	registry.Unlock()
+}
+
+// parseFingerprint identifies the settings parse depends on, a hosts map loaded by another
+// instance can only be served as is if both instances have the same fingerprint.
+func (h *HostsFile) parseFingerprint() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v %v %s %s", h.Origins, h.options.autoReverse, h.options.selector, h.options.varsString())
+	for _, zo := range h.options.zones {
+		fmt.Fprintf(&b, " %s:%v", zo.zone, zo.noReverse)
+	}
+	return b.String()
+}
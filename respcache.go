@@ -0,0 +1,126 @@
+package etcdhosts
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// defaultResponseCacheSize is the number of responses cached if response_cache has no size
+const defaultResponseCacheSize = 10000
+
+// responseKey identifies a cached response, the question name keeps its case because it is
+// copied into the response. The EDNS0 fields are part of the key because the OPT record of the
+// response mirrors them.
+type responseKey struct {
+	name  string
+	qtype uint16
+	rd    bool
+	cd    bool
+
+	edns    bool
+	udpSize uint16
+	do      bool
+	nsid    bool
+}
+
+// cachedResponse is a packed response and the number of its answer records.
+type cachedResponse struct {
+	packed  []byte
+	answers int
+}
+
+// responseCache holds packed responses of a snapshot, it is dropped together with the snapshot
+// so every etcd revision starts with an empty cache. Once size responses are cached no more
+// responses are added.
+type responseCache struct {
+	sync.Map
+	size int64
+	n    atomic.Int64
+}
+
+func newResponseCache(size int) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &responseCache{size: int64(size)}
+}
+
+func newResponseKey(r *dns.Msg) (responseKey, bool) {
+	if len(r.Question) != 1 || r.Opcode != dns.OpcodeQuery {
+		return responseKey{}, false
+	}
+	q := r.Question[0]
+	key := responseKey{name: q.Name, qtype: q.Qtype, rd: r.RecursionDesired, cd: r.CheckingDisabled}
+	if o := r.IsEdns0(); o != nil {
+		key.edns, key.udpSize, key.do, key.nsid = true, o.UDPSize(), o.Do(), wantsNSID(r)
+	}
+	return key, true
+}
+
+// get returns a copy of the response cached for r with the id of r and the number of its answer
+// records, nil if there is none.
+func (c *responseCache) get(r *dns.Msg) ([]byte, int) {
+	key, ok := newResponseKey(r)
+	if !ok {
+		return nil, 0
+	}
+	v, ok := c.Load(key)
+	if !ok {
+		return nil, 0
+	}
+	cr := v.(cachedResponse)
+	buf := make([]byte, len(cr.packed))
+	copy(buf, cr.packed)
+	binary.BigEndian.PutUint16(buf, r.Id)
+	return buf, cr.answers
+}
+
+// add caches the response m to r.
+func (c *responseCache) add(r, m *dns.Msg) {
+	if c.n.Load() >= c.size {
+		return
+	}
+	key, ok := newResponseKey(r)
+	if !ok {
+		return
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		return
+	}
+	if _, loaded := c.LoadOrStore(key, cachedResponse{packed: packed, answers: len(m.Answer)}); !loaded {
+		c.n.Add(1)
+	}
+}
+
+// cachesResponse reports whether the response to qname can be cached, answers that depend on the
+// client or on upstream lookups are never cached and dnstap needs every response.
+func (h *EtcdHosts) cachesResponse(qname string) bool {
+	if h.tapPlugin != nil || h.options.clientDependent() || h.options.ttlJitter > 0 || h.hasCanary(qname) {
+		return false
+	}
+	return h.LookupStaticAlias(qname) == ""
+}
+
+// clientDependent reports whether answers can differ between clients.
+func (o *options) clientDependent() bool {
+	if o.order != "" || o.dns64 != nil && len(o.dns64.nets) > 0 {
+		return true
+	}
+	for _, f := range o.filters {
+		if len(f.nets) > 0 {
+			return true
+		}
+	}
+	for _, zo := range o.zones {
+		for _, f := range zo.filters {
+			if len(f.nets) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package etcdhosts
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+const (
+	// reverseTag enables or disables the PTR entries of a hosts line, overriding auto_reverse
+	reverseTag = "reverse"
+	// ptrTag names the host name of a hosts line that PTR queries for its address answer first
+	ptrTag = "ptr"
+)
+
+// lineReverse returns the reverse tag of a hosts line, set is false if the line has none.
+func lineReverse(comment []byte) (reverse, set bool, err error) {
+	v, ok := lineTag(comment, reverseTag)
+	if !ok {
+		return false, false, nil
+	}
+	reverse, err = strconv.ParseBool(string(v))
+	return reverse, err == nil, err
+}
+
+// linePTR returns the normalized ptr tag of a hosts line, empty if it has none.
+func linePTR(comment []byte) string {
+	v, ok := lineTag(comment, ptrTag)
+	if !ok || len(v) == 0 {
+		return ""
+	}
+	return plugin.Name(string(v)).Normalize()
+}
+
+// setCanonical moves the canonical names of the addresses to the front of their PTR entries.
+func (h *Map) setCanonical(canonical map[netip.Addr]string) {
+	for addr, name := range canonical {
+		if addr.Is4() {
+			moveFirst(h.addr4[addr.As4()], name)
+		} else {
+			moveFirst(h.addr6[addr.As16()], name)
+		}
+	}
+}
+
+// moveFirst moves name to the front of names if names contains it.
+func moveFirst(names []string, name string) {
+	for i, n := range names {
+		if n == name {
+			copy(names[1:i+1], names[:i])
+			names[0] = name
+			return
+		}
+	}
+}
+
+// reverseZonesOf returns the reverse zones of the PTR entries of the maps, a /24 in-addr.arpa
+// zone per IPv4 network and a /64 ip6.arpa zone per IPv6 network, sorted.
+func reverseZonesOf(maps ...*Map) []string {
+	seen := make(map[string]struct{})
+	for _, m := range maps {
+		for a := range m.addr4 {
+			seen[fmt.Sprintf("%d.%d.%d.in-addr.arpa.", a[2], a[1], a[0])] = struct{}{}
+		}
+		for a := range m.addr6 {
+			var b strings.Builder
+			for i := 7; i >= 0; i-- {
+				fmt.Fprintf(&b, "%x.%x.", a[i]&0x0f, a[i]>>4)
+			}
+			b.WriteString("ip6.arpa.")
+			seen[b.String()] = struct{}{}
+		}
+	}
+
+	zones := make([]string, 0, len(seen))
+	for z := range seen {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// zones returns Origins followed by the reverse zones derived from the loaded hosts.
+func (h *HostsFile) zones() []string {
+	return append(h.Origins[:len(h.Origins):len(h.Origins)], h.snapshot().reverseZones...)
+}
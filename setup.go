@@ -2,145 +2,586 @@ package etcdhosts
 
 import (
 	"context"
+	"net"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	clientv3 "go.etcd.io/etcd/client/v3"
-
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	mwtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/coredns/coredns/plugin/pkg/trace"
+	"github.com/coredns/coredns/plugin/pkg/upstream"
 
 	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
 )
 
 var log = clog.NewWithPlugin("etcdhosts")
 
+// inlineFileInterval is the interval the inline file is checked for changes
+const inlineFileInterval = 5 * time.Second
+
+// defaultAuditRetention is how long the etcd audit entries are kept if audit_prefix sets no retention
+const defaultAuditRetention = 30 * 24 * time.Hour
+
+// defaultDebounceMaxWindows is the maximum wait of debounce in debounce windows if it is not set
+const defaultDebounceMaxWindows = 10
+
 func init() { plugin.Register("etcdhosts", setup) }
 
 func setup(c *caddy.Controller) error {
-	h, err := hostsParse(c)
+	hs, err := hostsParse(c)
 	if err != nil {
 		return plugin.Error("etcdhosts", err)
 	}
 
-	updateCancel := h.periodicHostsUpdate()
+	for _, h := range hs {
+		setupInstance(c, h)
+	}
+	return nil
+}
+
+// setupInstance registers the lifecycle callbacks and the handler of a single etcdhosts block.
+func setupInstance(c *caddy.Controller, h *EtcdHosts) {
+	stopUpdates := h.periodicHostsUpdate()
 
 	c.OnStartup(func() error {
-		h.readEtcdHosts()
+		if taph := dnsserver.GetConfig(c).Handler("dnstap"); taph != nil {
+			if tapPlugin, ok := taph.(dnstap.Dnstap); ok {
+				h.tapPlugin = &tapPlugin
+			}
+		}
+		if traceh := dnsserver.GetConfig(c).Handler("trace"); traceh != nil {
+			if t, ok := traceh.(trace.Trace); ok {
+				h.tracer = t.Tracer()
+			}
+		}
+		h.loadHosts(false)
+		if h.etcdConfig.ForceStart && !h.loaded.Load() && h.backups != nil {
+			h.backups.loadLatest()
+		}
 		return nil
 	})
 
+	// the registration, consul and backups use the etcd client, so they are stopped before the
+	// update goroutine closes it
+	if h.registration != nil {
+		c.OnStartup(h.registration.OnStartup)
+		c.OnShutdown(h.registration.OnShutdown)
+	}
+
+	if h.consul != nil {
+		c.OnStartup(h.consul.OnStartup)
+		c.OnShutdown(h.consul.OnShutdown)
+	}
+
+	if h.backups != nil {
+		c.OnStartup(h.backups.OnStartup)
+		c.OnShutdown(h.backups.OnShutdown)
+	}
+
 	c.OnShutdown(func() error {
-		updateCancel()
+		stopUpdates()
+		return nil
+	})
+
+	c.OnFinalShutdown(func() error {
+		dropStore(h.key)
+		forgetBlock(h.key)
 		return nil
 	})
 
+	if h.adminAddr != "" {
+		a := newAdmin(h, h.adminAddr)
+		c.OnStartup(a.OnStartup)
+		c.OnRestart(a.OnShutdown)
+		c.OnRestartFailed(a.OnStartup)
+		c.OnFinalShutdown(a.OnShutdown)
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		h.Next = next
 		return h
 	})
+}
 
-	return nil
+func hostsParse(c *caddy.Controller) ([]*EtcdHosts, error) {
+	var hs []*EtcdHosts
+	for c.Next() {
+		h, err := hostsParseBlock(c)
+		if err != nil {
+			for _, prev := range hs {
+				_ = prev.closeClient()
+			}
+			return nil, err
+		}
+		hs = append(hs, h)
+	}
+	return hs, nil
 }
 
-func hostsParse(c *caddy.Controller) (*EtcdHosts, error) {
+// hostsParseBlock parses a single etcdhosts block, blocks with the same etcd settings share a client.
+func hostsParseBlock(c *caddy.Controller) (*EtcdHosts, error) {
 	h := &EtcdHosts{
-		HostsFile: &HostsFile{
-			hmap:    newMap(),
-			inline:  newMap(),
-			options: newOptions(),
-		},
+		HostsFile:  newHostsFile(),
 		etcdConfig: &EtcdConfig{},
+		reloadCh:   make(chan bool, 1),
+		tracer:     ot.NoopTracer{},
+		upstream:   upstream.New(),
+		aliases:    newAliasCache(),
 	}
 
 	var inline []string
-	i := 0
-	for c.Next() {
-		if i > 0 {
-			return h, plugin.ErrOnce
-		}
-		i++
-
-		h.Origins = plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
-
-		for c.NextBlock() {
-			switch c.Val() {
-			case "fallthrough":
-				h.Fall.SetZonesFromArgs(c.RemainingArgs())
-			case "no_reverse":
-				h.options.autoReverse = false
-			case "ttl":
-				remaining := c.RemainingArgs()
-				if len(remaining) < 1 {
-					return h, c.Errf("ttl needs a time in second")
-				}
-				ttl, err := strconv.Atoi(remaining[0])
-				if err != nil {
-					return h, c.Errf("ttl needs a number of second")
-				}
-				if ttl <= 0 || ttl > 65535 {
-					return h, c.Errf("ttl provided is invalid")
-				}
-				h.options.ttl = uint32(ttl)
-			case "tls":
-				remaining := c.RemainingArgs()
-				tlsConfig, err := mwtls.NewTLSConfigFromArgs(remaining...)
-				if err != nil {
-					return h, c.Errf("failed to load etcd tls config: %s", err.Error())
-				}
-				h.etcdConfig.TLSConfig = tlsConfig
-			case "endpoint":
-				remaining := c.RemainingArgs()
-				if len(remaining) == 0 {
-					return h, c.ArgErr()
-				}
-				h.etcdConfig.Endpoints = remaining
-			case "timeout":
-				remaining := c.RemainingArgs()
-				if len(remaining) != 1 {
-					return h, c.Errf("timeout needs a duration")
-				}
-				timeout, err := time.ParseDuration(remaining[0])
-				if err != nil {
-					return h, c.Errf("invalid duration for timeout '%s'", remaining[0])
-				}
-				h.etcdConfig.Timeout = timeout
-			case "key":
-				remaining := c.RemainingArgs()
-				if len(remaining) != 1 {
-					return h, c.Errf("etcd hosts key needs a string")
-				}
-				h.etcdConfig.HostsKey = remaining[0]
-			case "credentials":
-				remaining := c.RemainingArgs()
-				if len(remaining) == 0 {
-					return h, c.ArgErr()
-				}
-				if len(remaining) != 2 {
-					return h, c.Errf("credentials requires 2 arguments, username and password")
-				}
-				h.etcdConfig.UserName, h.etcdConfig.Password = remaining[0], remaining[1]
-			case "force_reload":
-				remaining := c.RemainingArgs()
-				if len(remaining) != 1 {
-					return h, c.Errf("force_reload needs a duration")
-				}
-				forceReload, err := time.ParseDuration(remaining[0])
-				if err != nil {
-					return h, c.Errf("invalid duration for force_reload '%s'", remaining[0])
-				}
-				h.etcdConfig.ForceReload = forceReload
-			default:
-				if len(h.Fall.Zones) == 0 {
-					line := strings.Join(append([]string{c.Val()}, c.RemainingArgs()...), " ")
-					inline = append(inline, line)
+	var webhookURLs []string
+	var webhookSecret string
+	var consulArgs []string
+	var registerArgs []string
+	var rateLimitPrefix []string
+	backend, backendArgs := defaultBackend, []string(nil)
+
+	h.Origins = plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
+
+	for c.NextBlock() {
+		switch c.Val() {
+		case "fallthrough":
+			h.Fall.SetZonesFromArgs(c.RemainingArgs())
+		case "fallthrough_nodata":
+			h.FallNoData.SetZonesFromArgs(c.RemainingArgs())
+		case "no_reverse":
+			h.options.autoReverse = false
+		case "ttl_clamp":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 2 {
+				return h, c.Errf("ttl_clamp needs MIN MAX in seconds")
+			}
+			lo, err1 := strconv.ParseUint(remaining[0], 10, 32)
+			hi, err2 := strconv.ParseUint(remaining[1], 10, 32)
+			if err1 != nil || err2 != nil || hi == 0 || lo > hi {
+				return h, c.Errf("invalid ttl_clamp range '%s %s'", remaining[0], remaining[1])
+			}
+			h.options.ttlMin, h.options.ttlMax = uint32(lo), uint32(hi)
+		case "ttl_jitter":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("ttl_jitter needs a percentage")
+			}
+			p, err := strconv.ParseUint(remaining[0], 10, 32)
+			if err != nil || p == 0 || p >= 100 {
+				return h, c.Errf("ttl_jitter needs a percentage between 1 and 99")
+			}
+			h.options.ttlJitter = uint32(p)
+		case "max_change_ratio":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("max_change_ratio needs a percentage")
+			}
+			p, err := strconv.ParseFloat(remaining[0], 64)
+			if err != nil || p <= 0 || p > 100 {
+				return h, c.Errf("max_change_ratio needs a percentage between 0 and 100")
+			}
+			h.options.maxChangeRatio = p / 100
+		case "nsid":
+			remaining := c.RemainingArgs()
+			if len(remaining) > 1 {
+				return h, c.ArgErr()
+			}
+			nsid, err := os.Hostname()
+			if len(remaining) == 1 {
+				nsid, err = remaining[0], nil
+			}
+			if err != nil {
+				return h, c.Errf("nsid needs an identifier, failed to get the hostname: %s", err)
+			}
+			h.options.nsid = nsid
+		case "auto_reverse_zones":
+			if len(c.RemainingArgs()) != 0 {
+				return h, c.ArgErr()
+			}
+			h.options.autoReverseZones = true
+		case "ptr_canonical":
+			if len(c.RemainingArgs()) != 0 {
+				return h, c.ArgErr()
+			}
+			h.options.ptrCanonical = true
+		case "reverse":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 {
+				return h, c.ArgErr()
+			}
+			for _, r := range remaining {
+				if _, n, err := net.ParseCIDR(r); err == nil {
+					h.options.reverseNets = append(h.options.reverseNets, n)
 					continue
 				}
-				return h, c.Errf("unknown property '%s'", c.Val())
+				zone := plugin.Name(r).Normalize()
+				if !strings.HasSuffix(zone, ".in-addr.arpa.") && !strings.HasSuffix(zone, ".ip6.arpa.") {
+					return h, c.Errf("reverse needs a CIDR or a reverse zone, got '%s'", r)
+				}
+				h.options.reverseZones = append(h.options.reverseZones, zone)
+			}
+		case "filter_a", "filter_aaaa":
+			f, err := parseFilter(c)
+			if err != nil {
+				return h, err
+			}
+			h.options.filters = append(h.options.filters, f)
+		case "order":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.ArgErr()
+			}
+			if remaining[0] != orderRFC6724 {
+				return h, c.Errf("unknown order '%s'", remaining[0])
+			}
+			h.options.order = remaining[0]
+		case "response_cache":
+			remaining := c.RemainingArgs()
+			if len(remaining) > 1 {
+				return h, c.ArgErr()
+			}
+			size := defaultResponseCacheSize
+			if len(remaining) == 1 {
+				n, err := strconv.Atoi(remaining[0])
+				if err != nil || n <= 0 {
+					return h, c.Errf("response_cache needs a positive size")
+				}
+				size = n
+			}
+			h.options.responseCache = size
+		case "negative_cache":
+			remaining := c.RemainingArgs()
+			if len(remaining) > 1 {
+				return h, c.ArgErr()
+			}
+			size := defaultNegativeCacheSize
+			if len(remaining) == 1 {
+				n, err := strconv.Atoi(remaining[0])
+				if err != nil || n <= 0 {
+					return h, c.Errf("negative_cache needs a positive size")
+				}
+				size = n
+			}
+			h.options.negativeCache = size
+		case "soa":
+			so, err := parseSOA(c)
+			if err != nil {
+				return h, err
+			}
+			h.options.soa = so
+		case "any_hinfo":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 || len(remaining) > 2 {
+				return h, c.Errf("any_hinfo needs CPU [OS]")
+			}
+			h.options.anyCPU, h.options.anyOS = remaining[0], ""
+			if len(remaining) == 2 {
+				h.options.anyOS = remaining[1]
+			}
+		case "dns64":
+			d, err := parseDNS64(c)
+			if err != nil {
+				return h, err
+			}
+			h.options.dns64 = d
+		case "select":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("select needs a selector like env=prod,region=eu")
+			}
+			sel, err := parseSelector(remaining[0])
+			if err != nil {
+				return h, c.Errf("invalid selector: %s", err)
+			}
+			h.options.selector = sel
+		case "var":
+			name, value, err := parseVar(c.RemainingArgs())
+			if err != nil {
+				return h, c.Err(err.Error())
+			}
+			if h.options.vars == nil {
+				h.options.vars = make(map[string]string)
+			}
+			h.options.vars[name] = value
+		case "dry_run":
+			h.dryRun = true
+		case "debug_queries":
+			remaining := c.RemainingArgs()
+			if len(remaining) > 1 {
+				return h, c.ArgErr()
+			}
+			fraction := 1.0
+			if len(remaining) == 1 {
+				f, err := strconv.ParseFloat(remaining[0], 64)
+				if err != nil || f <= 0 || f > 1 {
+					return h, c.Errf("debug_queries needs a fraction between 0 and 1")
+				}
+				fraction = f
+			}
+			h.setDebugQueries(fraction)
+		case "ttl":
+			ttl, err := parseTTL(c)
+			if err != nil {
+				return h, err
+			}
+			h.options.ttl = ttl
+		case "zone":
+			zo, err := parseZoneOptions(c)
+			if err != nil {
+				return h, err
+			}
+			h.options.zones = append(h.options.zones, zo...)
+		case "tls":
+			remaining := c.RemainingArgs()
+			tlsConfig, err := mwtls.NewTLSConfigFromArgs(remaining...)
+			if err != nil {
+				return h, c.Errf("failed to load etcd tls config: %s", err.Error())
+			}
+			h.etcdConfig.TLSConfig = tlsConfig
+			h.etcdConfig.tlsArgs = remaining
+		case "endpoint":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 {
+				return h, c.ArgErr()
+			}
+			h.etcdConfig.Endpoints = remaining
+		case "ratelimit":
+			limiter, err := parseRateLimit(c.RemainingArgs())
+			if err != nil {
+				return h, c.Err(err.Error())
+			}
+			h.limiter = limiter
+		case "ratelimit_prefix":
+			rateLimitPrefix = c.RemainingArgs()
+			if len(rateLimitPrefix) == 0 {
+				return h, c.ArgErr()
+			}
+		case "verify":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 || len(remaining) > 2 {
+				return h, c.Errf("verify needs a public key file and an optional signature key suffix")
+			}
+			suffix := defaultSignatureSuffix
+			if len(remaining) == 2 {
+				suffix = remaining[1]
+			}
+			v, err := newVerifier(remaining[0], suffix)
+			if err != nil {
+				return h, c.Errf("invalid verify public key: %s", err)
+			}
+			h.verifier = v
+		case "encryption_key":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("encryption_key needs a key file")
+			}
+			vc, err := newValueCipher(remaining[0])
+			if err != nil {
+				return h, c.Errf("invalid encryption_key: %s", err)
+			}
+			h.cipher = vc
+		case "force_start":
+			if len(c.RemainingArgs()) != 0 {
+				return h, c.ArgErr()
+			}
+			h.etcdConfig.ForceStart = true
+		case "discovery":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 2 || remaining[0] != "srv" {
+				return h, c.Errf("discovery needs an SRV name like: discovery srv _etcd-client._tcp.example.com")
+			}
+			h.etcdConfig.Discovery = remaining[1]
+		case "timeout":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("timeout needs a duration")
+			}
+			timeout, err := time.ParseDuration(remaining[0])
+			if err != nil {
+				return h, c.Errf("invalid duration for timeout '%s'", remaining[0])
+			}
+			h.etcdConfig.Timeout = timeout
+		case "key":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 {
+				return h, c.Errf("etcd hosts key needs a string")
+			}
+			// the last key takes precedence and receives the admin api writes
+			h.etcdConfig.MergeKeys = remaining[:len(remaining)-1]
+			h.etcdConfig.HostsKey = remaining[len(remaining)-1]
+		case "merge":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.ArgErr()
+			}
+			if remaining[0] != mergeOverride && remaining[0] != mergeUnion {
+				return h, c.Errf("unknown merge policy '%s'", remaining[0])
+			}
+			h.etcdConfig.MergePolicy = remaining[0]
+		case "credentials":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 {
+				return h, c.ArgErr()
+			}
+			if err := h.etcdConfig.parseCredentials(remaining); err != nil {
+				return h, c.Err(err.Error())
+			}
+		case "force_reload":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("force_reload needs a duration")
+			}
+			forceReload, err := time.ParseDuration(remaining[0])
+			if err != nil {
+				return h, c.Errf("invalid duration for force_reload '%s'", remaining[0])
+			}
+			h.etcdConfig.ForceReload = forceReload
+		case "debounce":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 && len(remaining) != 2 {
+				return h, c.Errf("debounce needs a duration and an optional maximum wait")
+			}
+			debounce, err := time.ParseDuration(remaining[0])
+			if err != nil || debounce < 0 {
+				return h, c.Errf("invalid duration for debounce '%s'", remaining[0])
+			}
+			maxWait := defaultDebounceMaxWindows * debounce
+			if len(remaining) == 2 {
+				if maxWait, err = time.ParseDuration(remaining[1]); err != nil || maxWait < debounce {
+					return h, c.Errf("invalid maximum wait for debounce '%s'", remaining[1])
+				}
+			}
+			h.etcdConfig.Debounce, h.etcdConfig.DebounceMaxWait = debounce, maxWait
+		case "stale_threshold":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("stale_threshold needs a duration")
+			}
+			staleThreshold, err := time.ParseDuration(remaining[0])
+			if err != nil {
+				return h, c.Errf("invalid duration for stale_threshold '%s'", remaining[0])
 			}
+			h.staleThreshold = staleThreshold
+		case "backend":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 {
+				return h, c.ArgErr()
+			}
+			if _, ok := backends[remaining[0]]; !ok {
+				return h, c.Errf("unknown backend '%s'", remaining[0])
+			}
+			backend, backendArgs = remaining[0], remaining[1:]
+		case "inline_file":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("inline_file needs a file path")
+			}
+			h.inlineFile = remaining[0]
+		case "admin":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("admin needs a listen address")
+			}
+			h.adminAddr = remaining[0]
+		case "admin_token":
+			tokens, err := parseRole(c.RemainingArgs(), h.adminAuth.tokens)
+			if err != nil {
+				return h, c.Errf("admin_token %s", err)
+			}
+			h.adminAuth.tokens = tokens
+		case "admin_client":
+			clients, err := parseRole(c.RemainingArgs(), h.adminAuth.clients)
+			if err != nil {
+				return h, c.Errf("admin_client %s", err)
+			}
+			h.adminAuth.clients = clients
+		case "admin_tls":
+			if err := h.adminAuth.parseTLS(c.RemainingArgs()); err != nil {
+				return h, c.Errf("invalid admin_tls: %s", err)
+			}
+		case "webhook":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 {
+				return h, c.ArgErr()
+			}
+			for _, u := range remaining {
+				if _, err := url.ParseRequestURI(u); err != nil {
+					return h, c.Errf("invalid webhook url '%s'", u)
+				}
+			}
+			webhookURLs = remaining
+		case "webhook_secret":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("webhook_secret needs a string")
+			}
+			webhookSecret = remaining[0]
+		case "audit_log":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("audit_log needs a file path")
+			}
+			h.auditLog = remaining[0]
+		case "backup":
+			dir, interval, keep, err := parseBackup(c.RemainingArgs())
+			if err != nil {
+				return h, c.Err(err.Error())
+			}
+			h.backups = newBackups(h, dir, interval, keep)
+		case "staging_key":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 {
+				return h, c.Errf("staging_key needs an etcd key")
+			}
+			h.etcdConfig.StagingKey = remaining[0]
+		case "audit_prefix":
+			remaining := c.RemainingArgs()
+			if len(remaining) != 1 && len(remaining) != 2 {
+				return h, c.Errf("audit_prefix needs an etcd key prefix and an optional retention")
+			}
+			h.auditPrefix, h.auditRetention = remaining[0], defaultAuditRetention
+			if len(remaining) == 2 {
+				retention, err := time.ParseDuration(remaining[1])
+				if err != nil || retention < 0 || retention > 0 && retention < time.Second {
+					return h, c.Errf("invalid audit retention '%s'", remaining[1])
+				}
+				h.auditRetention = retention
+			}
+		case "consul":
+			remaining := c.RemainingArgs()
+			if len(remaining) < 3 {
+				return h, c.Errf("consul needs an address, a domain and at least one service")
+			}
+			if _, err := url.ParseRequestURI(remaining[0]); err != nil {
+				return h, c.Errf("invalid consul address '%s'", remaining[0])
+			}
+			consulArgs = remaining
+		case "expire_gc":
+			if len(c.RemainingArgs()) != 0 {
+				return h, c.ArgErr()
+			}
+			h.expireGC = true
+		case "register":
+			remaining := c.RemainingArgs()
+			if len(remaining) == 0 || len(remaining) > 2 {
+				return h, c.Errf("register needs an etcd key prefix and an optional address")
+			}
+			if len(remaining) == 2 && net.ParseIP(remaining[1]) == nil {
+				return h, c.Errf("invalid register address '%s'", remaining[1])
+			}
+			registerArgs = remaining
+		default:
+			if len(h.Fall.Zones) == 0 {
+				line := strings.Join(append([]string{c.Val()}, c.RemainingArgs()...), " ")
+				inline = append(inline, line)
+				continue
+			}
+			return h, c.Errf("unknown property '%s'", c.Val())
 		}
 	}
 
@@ -149,53 +590,328 @@ func hostsParse(c *caddy.Controller) (*EtcdHosts, error) {
 		h.etcdConfig.HostsKey = "/etcdhosts"
 	}
 
+	// default merge policy of multiple keys
+	if h.etcdConfig.MergePolicy == "" {
+		h.etcdConfig.MergePolicy = mergeOverride
+	}
+
 	// default etcd client timeout
 	if h.etcdConfig.Timeout == 0 {
 		h.etcdConfig.Timeout = 3 * time.Second
 	}
 
+	if h.adminAddr == "" && (h.adminAuth.tokens != nil || h.adminAuth.clients != nil || h.adminAuth.tlsConfig != nil) {
+		return h, c.Errf("admin_token, admin_client and admin_tls need admin")
+	}
+	if h.adminAuth.clients != nil && !h.adminAuth.verifiesClients() {
+		return h, c.Errf("admin_client needs admin_tls with a client CA")
+	}
+
+	if len(rateLimitPrefix) > 0 {
+		if h.limiter == nil {
+			return h, c.Errf("ratelimit_prefix needs ratelimit")
+		}
+		if err := h.limiter.parsePrefix(rateLimitPrefix); err != nil {
+			return h, c.Err(err.Error())
+		}
+	}
+
+	if backend != "etcd" && (h.auditPrefix != "" || len(consulArgs) > 0 || len(registerArgs) > 0 || h.expireGC ||
+		h.etcdConfig.StagingKey != "" || h.verifier != nil || h.cipher != nil) {
+		return h, c.Errf("audit_prefix, consul, register, expire_gc, staging_key, verify and encryption_key need the etcd backend")
+	}
+	if h.verifier != nil && (len(consulArgs) > 0 || h.expireGC) {
+		return h, c.Errf("consul and expire_gc can't write signed hosts data, they can't be used with verify")
+	}
+	st, err := backends[backend](h, backendArgs)
+	if err != nil {
+		return h, c.Errf("invalid %s backend: %s", backend, err)
+	}
+	h.storage = st
+
+	h.key = strings.Join(c.ServerBlockKeys, " ") + "|" + h.storage.String()
+
 	// create etcd client
-	if err := h.initEtcdClient(); err != nil {
-		return nil, c.Errf("failed to create etcd client: %s", err)
+	if backend == "etcd" {
+		if h.etcdConfig.Discovery != "" {
+			if len(h.etcdConfig.Endpoints) > 0 {
+				return nil, c.Errf("endpoint and discovery can't be used together")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), h.etcdConfig.Timeout)
+			endpoints, err := h.etcdConfig.discoverEndpoints(ctx)
+			cancel()
+			switch {
+			case err != nil && h.etcdConfig.ForceStart:
+				log.Warningf("failed to discover etcd endpoints, discovering in the background: %s", err)
+				endpoints = h.etcdConfig.pendingEndpoints()
+			case err != nil:
+				return nil, c.Errf("failed to discover etcd endpoints: %s", err)
+			}
+			h.etcdConfig.Endpoints = endpoints
+		}
+		if err := h.initEtcdClient(); err != nil {
+			return nil, c.Errf("failed to create etcd client: %s", err)
+		}
+	}
+	h.touch()
+
+	// serve the hosts of the instance replaced by a Corefile reload until the first load,
+	// the revision is only kept if the map was parsed with the same settings
+	if st, ok := loadStore(h.key); ok {
+		h.update(func(s *hostsSnapshot) {
+			s.hmap = st.hmap
+			s.data = st.data
+			if st.fingerprint == h.parseFingerprint() {
+				s.revision, s.digest = st.revision, st.digest
+			}
+		})
+	}
+
+	if len(webhookURLs) > 0 {
+		h.webhook = newWebhook(webhookURLs, webhookSecret)
+	}
+
+	if len(consulArgs) > 0 {
+		h.consul = newConsulBridge(h, strings.TrimSuffix(consulArgs[0], "/"), consulArgs[1], consulArgs[2:])
+	}
+
+	if len(registerArgs) > 0 {
+		addr := ""
+		if len(registerArgs) == 2 {
+			addr = registerArgs[1]
+		}
+		r, err := newRegistration(h, registerArgs[0], addr)
+		if err != nil {
+			_ = h.closeClient()
+			return nil, c.Errf("failed to set up the registration: %s", err)
+		}
+		h.registration = r
 	}
 
 	h.initInline(inline)
 	return h, nil
 }
 
-func (h *EtcdHosts) periodicHostsUpdate() context.CancelFunc {
+// parseTTL parses the arguments of a ttl property.
+func parseTTL(c *caddy.Controller) (uint32, error) {
+	remaining := c.RemainingArgs()
+	if len(remaining) < 1 {
+		return 0, c.Errf("ttl needs a time in second")
+	}
+	ttl, err := strconv.Atoi(remaining[0])
+	if err != nil {
+		return 0, c.Errf("ttl needs a number of second")
+	}
+	if ttl <= 0 || ttl > 65535 {
+		return 0, c.Errf("ttl provided is invalid")
+	}
+	return uint32(ttl), nil
+}
+
+// parseFilter parses a `filter_a [CIDRS...]` or `filter_aaaa [CIDRS...]` property.
+func parseFilter(c *caddy.Controller) (*answerFilter, error) {
+	f := &answerFilter{qtype: dns.TypeA}
+	if c.Val() == "filter_aaaa" {
+		f.qtype = dns.TypeAAAA
+	}
+	for _, arg := range c.RemainingArgs() {
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, c.Errf("invalid client network '%s'", arg)
+		}
+		f.nets = append(f.nets, n)
+	}
+	return f, nil
+}
+
+// parseZoneOptions parses a `zone ZONES... { ... }` property, the block overrides ttl and
+// no_reverse and adds answer filters for the names below the given zones.
+func parseZoneOptions(c *caddy.Controller) ([]*zoneOptions, error) {
+	zones := c.RemainingArgs()
+	if len(zones) == 0 {
+		return nil, c.ArgErr()
+	}
+	if !c.Next() || c.Val() != "{" {
+		return nil, c.Errf("zone needs a block of options")
+	}
+
+	var ttl uint32
+	var noReverse bool
+	var filters []*answerFilter
+	var soa *soaOptions
+	for c.Next() && c.Val() != "}" {
+		switch c.Val() {
+		case "ttl":
+			t, err := parseTTL(c)
+			if err != nil {
+				return nil, err
+			}
+			ttl = t
+		case "no_reverse":
+			noReverse = true
+		case "filter_a", "filter_aaaa":
+			f, err := parseFilter(c)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, f)
+		case "soa":
+			so, err := parseSOA(c)
+			if err != nil {
+				return nil, err
+			}
+			soa = so
+		default:
+			return nil, c.Errf("unknown zone property '%s'", c.Val())
+		}
+	}
+
+	zo := make([]*zoneOptions, len(zones))
+	for i, z := range zones {
+		zo[i] = &zoneOptions{zone: plugin.Name(z).Normalize(), ttl: ttl, noReverse: noReverse, filters: filters, soa: soa}
+	}
+	return zo, nil
+}
+
+// periodicHostsUpdate starts the goroutine that reloads the hosts, stop cancels it and waits
+// until its watches and tickers are stopped and the etcd client is released.
+func (h *EtcdHosts) periodicHostsUpdate() (stop func()) {
 	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+
+		// tick is time.Tick with tickers that are stopped on return
+		var tickers []*time.Ticker
+		defer func() {
+			for _, t := range tickers {
+				t.Stop()
+			}
+		}()
+		tick := func(d time.Duration) <-chan time.Time {
+			t := time.NewTicker(d)
+			tickers = append(tickers, t)
+			return t.C
+		}
+
 		reloadTick := make(<-chan time.Time)
 		if h.etcdConfig.ForceReload > 0 {
-			reloadTick = time.Tick(h.etcdConfig.ForceReload)
+			reloadTick = tick(h.etcdConfig.ForceReload)
+		}
+		inlineTick := make(<-chan time.Time)
+		if h.inlineFile != "" {
+			inlineTick = tick(inlineFileInterval)
+		}
+		// debounceCh fires once no watch event arrived for the debounce window or the maximum
+		// wait since the first pending event passed, debounceDeadline is zero while no reload is
+		// pending
+		var debounce *time.Timer
+		var debounceDeadline time.Time
+		debounceCh := make(<-chan time.Time)
+		syncTick := make(<-chan time.Time)
+		if h.etcdClient != nil {
+			syncTick = tick(1 * time.Minute)
 		}
-		watchCh := h.etcdClient.Watch(clientv3.WithRequireLeader(context.Background()), h.etcdConfig.HostsKey)
+		// startTick retries the first load of a force_start instance
+		startTick := make(<-chan time.Time)
+		if h.etcdConfig.ForceStart {
+			startTick = tick(forceStartRetryInterval)
+		}
+		credentialsTick := make(<-chan time.Time)
+		if h.etcdClient != nil && len(h.etcdConfig.credentialFiles) > 0 {
+			credentialsTick = tick(credentialsCheckInterval)
+		}
+		watchCh := h.storage.watch(ctx)
+		timedTick := tick(timedCheckInterval)
 		for {
 			select {
 			case <-ctx.Done():
+				if debounce != nil {
+					debounce.Stop()
+				}
+				// the storage closes the channel once all its watches are closed, the client
+				// is only released after that
+				if watchCh != nil {
+					for range watchCh {
+					}
+				}
 				if err := h.closeClient(); err != nil {
 					log.Errorf("etcdhosts client close failed: %s", err.Error())
 				}
 				return
-			case <-time.Tick(1 * time.Minute):
+			case <-syncTick:
 				if err := h.syncEndpoints(); err != nil {
 					log.Errorf("etcdhosts client sync error: %s", err.Error())
 					continue
 				}
-				log.Infof("etcdhosts client endpoints sync success: %v", h.etcdClient.Endpoints())
+				h.touch()
+				log.Infof("etcdhosts client endpoints sync success: %v", h.client().Endpoints())
 			case <-reloadTick:
 				log.Info("etcdhosts force reloading...")
-				h.readEtcdHosts()
+				h.loadHosts(false)
+			case <-inlineTick:
+				h.readInlineFile()
+			case <-startTick:
+				if h.loaded.Load() {
+					startTick = nil
+					continue
+				}
+				log.Info("etcdhosts retrying the first load...")
+				// endpoints that couldn't be discovered at setup are discovered before every retry
+				if h.etcdConfig.Discovery != "" {
+					if err := h.syncEndpoints(); err != nil {
+						log.Errorf("etcdhosts client sync error: %s", err.Error())
+						continue
+					}
+				}
+				h.loadHosts(false)
+			case <-credentialsTick:
+				h.refreshCredentials()
+			case <-timedTick:
+				h.refreshTimedHosts()
+			case force := <-h.reloadCh:
+				log.Info("etcdhosts reloading on admin request...")
+				h.loadHosts(force)
 			case _, ok := <-watchCh:
 				if !ok {
-					log.Error("failed to watch etcd events: channel read failed")
+					log.Errorf("failed to watch hosts [%s]: channel closed", h.storage)
+					watchCh = nil
+					continue
+				}
+				if h.etcdConfig.Debounce > 0 {
+					now := time.Now()
+					if debounceDeadline.IsZero() {
+						debounceDeadline = now.Add(h.etcdConfig.DebounceMaxWait)
+					}
+					wait := h.etcdConfig.Debounce
+					if d := debounceDeadline.Sub(now); d < wait {
+						wait = d
+					}
+					if debounce == nil {
+						debounce = time.NewTimer(wait)
+						debounceCh = debounce.C
+					} else {
+						if !debounce.Stop() {
+							select {
+							case <-debounce.C:
+							default:
+							}
+						}
+						debounce.Reset(wait)
+					}
 					continue
 				}
 				log.Info("etcdhosts reloading...")
-				h.readEtcdHosts()
+				h.loadHosts(false)
+			case <-debounceCh:
+				debounceDeadline = time.Time{}
+				log.Info("etcdhosts reloading...")
+				h.loadHosts(false)
 			}
 		}
 	}()
-	return cancel
+	return func() {
+		cancel()
+		<-done
+	}
 }
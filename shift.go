@@ -0,0 +1,169 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+// defaultShiftSteps is the number of updates a weight shift is split into by default
+const defaultShiftSteps = 10
+
+// shiftConflictRetries is the number of times a step is retried if the hosts were modified concurrently
+const shiftConflictRetries = 3
+
+// shiftRequest is the JSON body that starts a weight shift.
+type shiftRequest struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Duration string `json:"duration"`
+	Steps    int    `json:"steps"`
+}
+
+// weightShift gradually moves the clients of a host name from one address to another by raising
+// the canary percentage of the new address in steps, the old address is removed at 100%.
+type weightShift struct {
+	Host     string `json:"host"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Duration string `json:"duration"`
+	Percent  int32  `json:"percent"`
+
+	steps   int
+	percent atomic.Int32
+	cancel  context.CancelFunc
+}
+
+// status returns a copy of the shift with the current percentage for the admin api.
+func (s *weightShift) status() weightShift {
+	return weightShift{Host: s.Host, From: s.From, To: s.To, Duration: s.Duration, Percent: s.percent.Load()}
+}
+
+// newWeightShift validates req against the loaded records of name.
+func (a *admin) newWeightShift(name string, req shiftRequest) (*weightShift, time.Duration, error) {
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		return nil, 0, errors.New("invalid duration: " + req.Duration)
+	}
+	steps := req.Steps
+	if steps == 0 {
+		steps = defaultShiftSteps
+	}
+	if steps < 1 || steps > 100 {
+		return nil, 0, errors.New("steps must be between 1 and 100")
+	}
+	from, ok := parseAddr(req.From)
+	if !ok {
+		return nil, 0, errors.New("invalid ip: " + req.From)
+	}
+	to, ok := parseAddr(req.To)
+	if !ok {
+		return nil, 0, errors.New("invalid ip: " + req.To)
+	}
+	if from == to {
+		return nil, 0, errors.New("from and to must differ")
+	}
+	if !a.h.hasAddr(name, from) {
+		return nil, 0, fmt.Errorf("%s is not an address of %s", from, name)
+	}
+	return &weightShift{Host: name, From: from.String(), To: to.String(), Duration: d.String(), steps: steps}, d / time.Duration(steps), nil
+}
+
+// hasAddr reports whether addr is an address of name in the hosts loaded from the storage.
+func (h *HostsFile) hasAddr(name string, addr netip.Addr) bool {
+	s := h.snapshot()
+	if addr.Is4() {
+		for _, a := range s.hmap.name4[name] {
+			if a == addr.As4() {
+				return true
+			}
+		}
+		return false
+	}
+	for _, a := range s.hmap.name6[name] {
+		if a == addr.As16() {
+			return true
+		}
+	}
+	return false
+}
+
+// runShift writes the steps of s every interval until it reaches 100% or is canceled, a canceled
+// shift keeps the percentage of its last step.
+func (a *admin) runShift(ctx context.Context, s *weightShift, interval time.Duration) {
+	defer a.endShift(s)
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for i := 1; i <= s.steps; i++ {
+		select {
+		case <-ctx.Done():
+			log.Infof("weight shift of %s canceled at %d%%", s.Host, s.percent.Load())
+			return
+		case <-tick.C:
+		}
+
+		percent := 100 * i / s.steps
+		if err := a.shiftStep(s, percent); err != nil {
+			log.Errorf("weight shift of %s stopped at %d%%: %s", s.Host, s.percent.Load(), err)
+			return
+		}
+		log.Infof("weight shift of %s from %s to %s at %d%%", s.Host, s.From, s.To, percent)
+	}
+}
+
+// shiftStep writes percent of s, the write is retried if the hosts were modified concurrently.
+func (a *admin) shiftStep(s *weightShift, percent int) error {
+	var err error
+	for i := 0; i < shiftConflictRetries; i++ {
+		err = a.h.saveEtcdHosts(func(hosts []byte) ([]byte, error) {
+			return shiftHost(hosts, s.Host, s.From, s.To, percent), nil
+		})
+		if !errors.Is(err, errHostsConflict) {
+			break
+		}
+	}
+	if err == nil {
+		s.percent.Store(int32(percent))
+	}
+	return err
+}
+
+// endShift forgets s once it completed or was canceled.
+func (a *admin) endShift(s *weightShift) {
+	a.Lock()
+	defer a.Unlock()
+	if a.shifts[s.Host] == s {
+		delete(a.shifts, s.Host)
+	}
+}
+
+// shiftHost writes to as canary address of name with percent, at 100% to becomes a regular
+// address and from is removed.
+func shiftHost(hosts []byte, name, from, to string, percent int) []byte {
+	fromAddr, _ := parseAddr(from)
+	toAddr, _ := parseAddr(to)
+	hosts = removeAddrHosts(hosts, func(addr netip.Addr, n string) bool {
+		return n == name && (addr == toAddr || percent >= 100 && addr == fromAddr)
+	})
+
+	buf := bytes.NewBuffer(hosts)
+	buf.WriteString(to + " " + strings.TrimSuffix(name, "."))
+	if percent < 100 {
+		fmt.Fprintf(buf, " # %s=%d", canaryTag, percent)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// shiftName returns the host name of a /shifts/{host} path.
+func shiftName(path string) string {
+	return plugin.Name(strings.TrimPrefix(path, "/shifts/")).Normalize()
+}
@@ -0,0 +1,96 @@
+package etcdhosts
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultSignatureSuffix is appended to a key to get the key of its signature
+const defaultSignatureSuffix = ".sig"
+
+// errSigned is returned when hosts data is written without its signature.
+var errSigned = signedError{}
+
+// signedError is the error of writing signed hosts data, it is also errReadOnly so the admin API
+// answers it like a write to a read only backend.
+type signedError struct{}
+
+func (signedError) Error() string {
+	return "hosts data is signed, it can only be replaced together with its signature"
+}
+
+func (signedError) Is(target error) bool { return target == errReadOnly }
+
+// verifier checks the signatures of the hosts data, a signature is the base64 encoded Ed25519
+// signature of the decrypted value or the ASN.1 ECDSA signature of its SHA-256 digest.
+type verifier struct {
+	key    crypto.PublicKey
+	suffix string
+}
+
+// newVerifier reads the PEM encoded Ed25519 or ECDSA public key in file.
+func newVerifier(file, suffix string) (*verifier, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("public key in %s is neither Ed25519 nor ECDSA", file)
+	}
+	return &verifier{key: key, suffix: suffix}, nil
+}
+
+// signatureKey returns the key holding the signature of key.
+func (v *verifier) signatureKey(key string) string {
+	return key + v.suffix
+}
+
+// verify checks the base64 encoded signature of data.
+func (v *verifier) verify(data, signature []byte) error {
+	if len(signature) == 0 {
+		return errors.New("missing signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %s", err)
+	}
+	valid := false
+	switch key := v.key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, data, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		valid = ecdsa.VerifyASN1(key, digest[:], sig)
+	}
+	if !valid {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// verifyKey checks the signature of the value of key.
+func (v *verifier) verifyKey(key string, data, signature []byte) error {
+	if err := v.verify(data, signature); err != nil {
+		return fmt.Errorf("rejecting [%s]: %s", key, err)
+	}
+	return nil
+}
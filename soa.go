@@ -0,0 +1,104 @@
+package etcdhosts
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// The SOA timers used if the soa property only sets the names.
+const (
+	defaultSOARefresh = 7200
+	defaultSOARetry   = 1800
+	defaultSOAExpire  = 86400
+	defaultSOAMinimum = 30
+)
+
+// soaOptions are the SOA parameters of an origin, the serial is the revision of the loaded hosts.
+type soaOptions struct {
+	mname string
+	rname string
+
+	refresh uint32
+	retry   uint32
+	expire  uint32
+
+	// minimum is the negative caching TTL of NXDOMAIN and NODATA responses
+	minimum uint32
+}
+
+// parseSOA parses a `soa MNAME RNAME [REFRESH RETRY EXPIRE MINIMUM]` property, RNAME may be
+// written as a mail address.
+func parseSOA(c *caddy.Controller) (*soaOptions, error) {
+	remaining := c.RemainingArgs()
+	if len(remaining) != 2 && len(remaining) != 6 {
+		return nil, c.Errf("soa needs MNAME RNAME [REFRESH RETRY EXPIRE MINIMUM]")
+	}
+	so := &soaOptions{
+		mname:   plugin.Name(remaining[0]).Normalize(),
+		rname:   plugin.Name(strings.Replace(remaining[1], "@", ".", 1)).Normalize(),
+		refresh: defaultSOARefresh,
+		retry:   defaultSOARetry,
+		expire:  defaultSOAExpire,
+		minimum: defaultSOAMinimum,
+	}
+	for i, v := range []*uint32{&so.refresh, &so.retry, &so.expire, &so.minimum} {
+		if len(remaining) == 2 {
+			break
+		}
+		n, err := strconv.ParseUint(remaining[2+i], 10, 32)
+		if err != nil {
+			return nil, c.Errf("invalid soa timer '%s'", remaining[2+i])
+		}
+		*v = uint32(n)
+	}
+	return so, nil
+}
+
+// soaFor returns the SOA options of name in zone and the owner of the SOA record, the SOA of the
+// most specific zone block takes precedence over the global one. so is nil if no SOA is configured.
+func (o *options) soaFor(name, zone string) (owner string, so *soaOptions) {
+	if zo := o.zoneOptions(name); zo != nil && zo.soa != nil {
+		return zo.zone, zo.soa
+	}
+	if zone == "" {
+		return "", nil
+	}
+	return zone, o.soa
+}
+
+// soa returns the SOA record of the zone of name, nil if no SOA is configured. The TTL is the TTL
+// of the owner, negative responses lower it to the minimum.
+func (h *EtcdHosts) soa(name, zone string) *dns.SOA {
+	owner, so := h.options.soaFor(name, zone)
+	if so == nil {
+		return nil
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: owner, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: h.options.ttlFor(owner)},
+		Ns:      so.mname,
+		Mbox:    so.rname,
+		Serial:  uint32(h.snapshot().revision),
+		Refresh: so.refresh,
+		Retry:   so.retry,
+		Expire:  so.expire,
+		Minttl:  so.minimum,
+	}
+}
+
+// negativeSOA returns the SOA record for the authority section of a negative response, its TTL is
+// the negative caching TTL (RFC 2308).
+func (h *EtcdHosts) negativeSOA(name, zone string) []dns.RR {
+	soa := h.soa(name, zone)
+	if soa == nil {
+		return nil
+	}
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return []dns.RR{soa}
+}
@@ -0,0 +1,118 @@
+package etcdhosts
+
+import (
+	"context"
+	"errors"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// errNoStaging is returned by the staging operations if no staging key is configured
+var errNoStaging = errors.New("no staging key configured")
+
+// errStagingChanged is returned on promotion if the staging key changed since it was reviewed
+var errStagingChanged = errors.New("staging key was modified since the reviewed revision")
+
+// stagingReview is the result of validating the staged hosts and comparing them to the live hosts.
+type stagingReview struct {
+	Revision int64          `json:"revision"`
+	Findings []finding      `json:"findings"`
+	Changes  []recordChange `json:"changes"`
+}
+
+// stagingValues reads the staged and the live hosts in a single transaction and returns them
+// with their mod revisions.
+func (h *EtcdHosts) stagingValues(ctx context.Context) (staged, live []byte, stagedRev, liveRev int64, err error) {
+	if h.etcdClient == nil || h.etcdConfig.StagingKey == "" {
+		return nil, nil, 0, 0, errNoStaging
+	}
+	resp, err := h.client().Txn(ctx).Then(
+		clientv3.OpGet(h.etcdConfig.StagingKey),
+		clientv3.OpGet(h.etcdConfig.HostsKey),
+	).Commit()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) == 1 {
+		if staged, err = h.cipher.decrypt(h.etcdConfig.StagingKey, kvs[0].Value); err != nil {
+			return nil, nil, 0, 0, err
+		}
+		stagedRev = kvs[0].ModRevision
+	}
+	if kvs := resp.Responses[1].GetResponseRange().Kvs; len(kvs) == 1 {
+		if live, err = h.cipher.decrypt(h.etcdConfig.HostsKey, kvs[0].Value); err != nil {
+			return nil, nil, 0, 0, err
+		}
+		liveRev = kvs[0].ModRevision
+	}
+	return staged, live, stagedRev, liveRev, nil
+}
+
+// reviewStaging validates the staged hosts and returns the changes promoting them would make.
+func (h *EtcdHosts) reviewStaging(ctx context.Context) (*stagingReview, error) {
+	staged, live, stagedRev, _, err := h.stagingValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &stagingReview{
+		Revision: stagedRev,
+		Findings: append([]finding{}, h.validateHosts(staged)...),
+		Changes:  append([]recordChange{}, diffMaps(h.parse(live), h.parse(staged))...),
+	}, nil
+}
+
+// promoteStaging copies the staged hosts to the hosts key, the write only succeeds if neither key
+// changed since they were read. If revision is not 0 the staging key must still be at revision,
+// so exactly the reviewed hosts are promoted. Staged hosts with findings are never promoted. If
+// signatures are verified the signature of the staged hosts must be valid and is promoted with them.
+func (h *EtcdHosts) promoteStaging(ctx context.Context, revision int64) (*stagingReview, error) {
+	staged, _, stagedRev, liveRev, err := h.stagingValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if revision != 0 && revision != stagedRev {
+		return nil, errStagingChanged
+	}
+	if stagedRev == 0 {
+		return &stagingReview{Findings: []finding{{Message: "staging key is empty"}}}, nil
+	}
+	if findings := h.validateHosts(staged); len(findings) > 0 {
+		return &stagingReview{Revision: stagedRev, Findings: findings}, nil
+	}
+
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(h.etcdConfig.StagingKey), "=", stagedRev),
+		clientv3.Compare(clientv3.ModRevision(h.etcdConfig.HostsKey), "=", liveRev),
+	}
+	// the staged hosts are encrypted again because the key is part of the encryption
+	value, err := h.cipher.encrypt(h.etcdConfig.HostsKey, staged)
+	if err != nil {
+		return nil, err
+	}
+	ops := []clientv3.Op{clientv3.OpPut(h.etcdConfig.HostsKey, string(value))}
+	if v := h.verifier; v != nil {
+		sigResp, err := h.client().Get(ctx, v.signatureKey(h.etcdConfig.StagingKey))
+		if err != nil {
+			return nil, err
+		}
+		var signature []byte
+		var sigRev int64
+		if len(sigResp.Kvs) == 1 {
+			signature, sigRev = sigResp.Kvs[0].Value, sigResp.Kvs[0].ModRevision
+		}
+		if err := v.verify(staged, signature); err != nil {
+			return &stagingReview{Revision: stagedRev, Findings: []finding{{Message: err.Error()}}}, nil
+		}
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(v.signatureKey(h.etcdConfig.StagingKey)), "=", sigRev))
+		ops = append(ops, clientv3.OpPut(v.signatureKey(h.etcdConfig.HostsKey), string(signature)))
+	}
+
+	resp, err := h.client().Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Succeeded {
+		return nil, errHostsConflict
+	}
+	return nil, nil
+}
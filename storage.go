@@ -0,0 +1,63 @@
+package etcdhosts
+
+import (
+	"context"
+	"errors"
+)
+
+// defaultBackend is the backend used if the backend property is not set
+const defaultBackend = "etcd"
+
+// errReadOnly is returned when hosts data is written to a backend that only supports reading.
+var errReadOnly = errors.New("hosts data can only be modified with the etcd backend")
+
+// storage is a source of hosts data.
+type storage interface {
+	// load returns the hosts data and the revision it was read at, e.g. the etcd revision, data is
+	// nil and the revision 0 if there is no hosts data. Changes are detected from the data, so
+	// the revision may change without the data.
+	load(ctx context.Context) (data []byte, revision int64, err error)
+
+	// watch returns a channel that receives a value whenever the hosts data may have changed,
+	// the channel is closed once ctx is done.
+	watch(ctx context.Context) <-chan struct{}
+
+	// String identifies the hosts data of the storage, e.g. the etcd key.
+	String() string
+}
+
+// keyStorage is a storage that keeps the hosts data in several keys, e.g. the etcd keys with their
+// includes and signatures. Backups of a keyStorage hold the stored value of every key instead of
+// the merged hosts data.
+type keyStorage interface {
+	storage
+
+	// loadKeys returns the stored values of the keys load reads and the revision they were read
+	// at, the keys are nil and the revision 0 if there is no hosts data.
+	loadKeys(ctx context.Context) (keys []storedKey, revision int64, err error)
+
+	// assembleKeys returns the hosts data load would return for the stored keys.
+	assembleKeys(keys []storedKey) ([]byte, error)
+
+	// restoreKeys writes the stored hosts key back, or every stored key if all is set. The keys
+	// load reads directly that are restored but not among the stored keys are deleted.
+	restoreKeys(ctx context.Context, keys []storedKey, all bool) error
+}
+
+// storedKey is a key of a keyStorage as stored, e.g. encrypted values stay encrypted.
+type storedKey struct {
+	Key         string `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision"`
+}
+
+// backendFunc creates the storage of h from the arguments of the backend property.
+type backendFunc func(h *EtcdHosts, args []string) (storage, error)
+
+// backends are the storages selectable with the backend property.
+var backends = make(map[string]backendFunc)
+
+// registerBackend makes a storage available to the backend property under name.
+func registerBackend(name string, f backendFunc) {
+	backends[name] = f
+}
@@ -0,0 +1,124 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// requirement is a single `key=value` or `key!=value` term of a selector.
+type requirement struct {
+	key   string
+	value string
+	not   bool
+}
+
+// selector selects hosts lines by their tags, a line is selected if it meets all requirements.
+type selector []requirement
+
+// parseSelector parses a comma separated list of `key=value` and `key!=value` requirements.
+func parseSelector(s string) (selector, error) {
+	var sel selector
+	for _, term := range strings.Split(s, ",") {
+		var r requirement
+		if i := strings.Index(term, "!="); i >= 0 {
+			r = requirement{key: term[:i], value: term[i+2:], not: true}
+		} else if i := strings.Index(term, "="); i >= 0 {
+			r = requirement{key: term[:i], value: term[i+1:]}
+		} else {
+			return nil, fmt.Errorf("invalid requirement '%s'", term)
+		}
+		if r.key == "" {
+			return nil, fmt.Errorf("invalid requirement '%s'", term)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// matches reports whether tags meet all requirements, a missing tag meets `key!=value` only.
+func (s selector) matches(tags map[string]string) bool {
+	for _, r := range s {
+		v, ok := tags[r.key]
+		if r.not == (ok && v == r.value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s selector) String() string {
+	terms := make([]string, len(s))
+	for i, r := range s {
+		op := "="
+		if r.not {
+			op = "!="
+		}
+		terms[i] = r.key + op + r.value
+	}
+	return strings.Join(terms, ",")
+}
+
+// lineTags returns the `key=value` words of the comment of a hosts line as tags.
+func lineTags(comment []byte) map[string]string {
+	tags := make(map[string]string)
+	for _, f := range bytes.Fields(comment) {
+		if i := bytes.IndexByte(f, '='); i > 0 {
+			tags[string(f[:i])] = string(f[i+1:])
+		}
+	}
+	return tags
+}
+
+// mergeTags returns the tags of a and b, b wins for keys in both. Neither map is modified.
+func mergeTags(a, b map[string]string) map[string]string {
+	if len(a) == 0 {
+		return b
+	}
+	merged := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// checkTags reports tags that can't be written to the comment of a hosts line.
+func checkTags(tags map[string]string) error {
+	for k, v := range tags {
+		if k == "" || strings.ContainsRune(k, '=') || strings.IndexFunc(k, unsafeHostsRune) >= 0 || strings.IndexFunc(v, unsafeHostsRune) >= 0 {
+			return fmt.Errorf("invalid tag %q=%q", k, v)
+		}
+	}
+	return nil
+}
+
+// unsafeHostsRune reports whether r can't be written into a field of a hosts line, it would end the
+// field, the line or start the comment.
+func unsafeHostsRune(r rune) bool {
+	return r == '#' || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+// formatTags returns tags as the comment of a hosts line, sorted by key.
+func formatTags(tags map[string]string) string {
+	fields := make([]string, 0, len(tags))
+	for k, v := range tags {
+		fields = append(fields, k+"="+v)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, " ")
+}
+
+// lineTag returns the value of the tag key in the comment of a hosts line.
+func lineTag(comment []byte, key string) ([]byte, bool) {
+	for _, f := range bytes.Fields(comment) {
+		if v, found := bytes.CutPrefix(f, []byte(key+"=")); found {
+			return v, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,43 @@
+package etcdhosts
+
+import (
+	"math/rand"
+
+	"github.com/miekg/dns"
+)
+
+// clampTTL limits ttl to the configured ttl_clamp range.
+func (o *options) clampTTL(ttl uint32) uint32 {
+	if o.ttlMin > 0 && ttl < o.ttlMin {
+		return o.ttlMin
+	}
+	if o.ttlMax > 0 && ttl > o.ttlMax {
+		return o.ttlMax
+	}
+	return ttl
+}
+
+// jitterTTL returns copies of rrs with their TTL lowered by a random amount of up to ttlJitter
+// percent, so resolvers caching a popular name don't all expire it at the same time. The records
+// are copied because answers are shared between queries.
+func (o *options) jitterTTL(rrs []dns.RR) []dns.RR {
+	if o.ttlJitter == 0 || len(rrs) == 0 {
+		return rrs
+	}
+	// all records of a response get the same TTL, an RRset must not have different TTLs
+	ttl := rrs[0].Header().Ttl
+	ttl -= uint32(rand.Int63n(int64(ttl)*int64(o.ttlJitter)/100 + 1))
+	if ttl < o.ttlMin {
+		ttl = o.ttlMin
+	}
+	if ttl == 0 {
+		ttl = 1
+	}
+
+	jittered := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		jittered[i] = dns.Copy(rr)
+		jittered[i].Header().Ttl = ttl
+	}
+	return jittered
+}
@@ -0,0 +1,155 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// finding is a problem detected while validating hosts data, Column (1-based, in bytes) and
+// Token locate the offending field of the line if there is one. Columns of lines with
+// variables refer to the expanded line.
+type finding struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Message string `json:"message"`
+}
+
+// tokenFinding returns a finding for token, a subslice of line that shares its end (see fields).
+func tokenFinding(n int, line, token []byte, message string) finding {
+	return finding{Line: n, Column: cap(line) - cap(token) + 1, Token: string(token), Message: message}
+}
+
+// fields is like bytes.Fields but keeps the capacity of the fields, so the column of a field
+// follows from its capacity.
+func fields(line []byte) [][]byte {
+	var f [][]byte
+	start := -1
+	for i, c := range line {
+		switch {
+		case c != ' ' && c != '\t' && c != '\r' && c != '\v' && c != '\f':
+			if start < 0 {
+				start = i
+			}
+		case start >= 0:
+			f = append(f, line[start:i])
+			start = -1
+		}
+	}
+	if start >= 0 {
+		f = append(f, line[start:])
+	}
+	return f
+}
+
+// tagField returns the key=value field of the tag key in a comment, nil if there is none.
+func tagField(comment []byte, key string) []byte {
+	for _, f := range fields(comment) {
+		if bytes.HasPrefix(f, []byte(key+"=")) {
+			return f
+		}
+	}
+	return nil
+}
+
+func (f finding) String() string {
+	if f.Token == "" {
+		return fmt.Sprintf("line %d: %s", f.Line, f.Message)
+	}
+	return fmt.Sprintf("line %d column %d %q: %s", f.Line, f.Column, f.Token, f.Message)
+}
+
+// validateHosts runs strict checks against hosts data and returns every finding, lines that
+// parse silently skips (malformed addresses, missing names, names outside Origins) are reported.
+func (h *HostsFile) validateHosts(hosts []byte) []finding {
+	var findings []finding
+	seen := make(map[string]int)
+
+	for i, raw := range hostsLines(hosts) {
+		n := i + 1
+		full, undefined := h.options.expandVars(raw)
+		for _, name := range undefined {
+			v := []byte("${" + name + "}")
+			findings = append(findings, tokenFinding(n, raw, raw[bytes.Index(raw, v):][:len(v)], "undefined variable"))
+		}
+		line, comment := full, []byte(nil)
+		if i := bytes.Index(line, []byte{'#'}); i >= 0 {
+			line, comment = line[0:i], line[i+1:]
+		}
+		f := fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) < 2 {
+			findings = append(findings, tokenFinding(n, full, f[0], "missing host names"))
+			continue
+		}
+		for _, key := range []string{startsTag, expiresTag} {
+			if _, _, err := lineTime(comment, key); err != nil {
+				findings = append(findings, tokenFinding(n, full, tagField(comment, key), key+" must be an RFC 3339 timestamp"))
+			}
+		}
+		if bytes.EqualFold(f[0], []byte(aliasKeyword)) {
+			if len(f) != 3 {
+				findings = append(findings, finding{Line: n, Message: "ALIAS needs a host name and a target"})
+				continue
+			}
+			for _, name := range f[1:] {
+				if _, ok := dns.IsDomainName(string(name)); !ok {
+					findings = append(findings, tokenFinding(n, full, name, "invalid host name"))
+				}
+			}
+			if plugin.Zones(h.Origins).Matches(plugin.Name(string(f[1])).Normalize()) == "" {
+				findings = append(findings, tokenFinding(n, full, f[1], "host is not in the plugin origins"))
+			}
+			continue
+		}
+		addr := parseIP(string(f[0]))
+		if addr == nil {
+			findings = append(findings, tokenFinding(n, full, f[0], "invalid ip address"))
+			continue
+		}
+		if _, _, err := lineCanary(comment); err != nil {
+			findings = append(findings, tokenFinding(n, full, tagField(comment, canaryTag), "canary must be a percentage between 0 and 100"))
+		}
+		if _, _, err := lineReverse(comment); err != nil {
+			findings = append(findings, tokenFinding(n, full, tagField(comment, reverseTag), "reverse must be true or false"))
+		}
+		if ptr := linePTR(comment); ptr != "" && !containsName(f[1:], ptr) {
+			findings = append(findings, tokenFinding(n, full, tagField(comment, ptrTag), "ptr is not a host name of the line"))
+		}
+
+		for _, name := range f[1:] {
+			if _, ok := dns.IsDomainName(string(name)); !ok {
+				findings = append(findings, tokenFinding(n, full, name, "invalid host name"))
+				continue
+			}
+			normalized := plugin.Name(string(name)).Normalize()
+			if plugin.Zones(h.Origins).Matches(normalized) == "" {
+				findings = append(findings, tokenFinding(n, full, name, "host is not in the plugin origins"))
+				continue
+			}
+			pair := addr.String() + " " + normalized
+			if first, ok := seen[pair]; ok {
+				findings = append(findings, tokenFinding(n, full, name, fmt.Sprintf("duplicate entry %q, first defined on line %d", pair, first)))
+				continue
+			}
+			seen[pair] = n
+		}
+	}
+	return findings
+}
+
+// containsName reports whether one of the host names normalizes to name.
+func containsName(names [][]byte, name string) bool {
+	for _, n := range names {
+		if plugin.Name(string(n)).Normalize() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// varPattern matches the ${name} variables of a hosts line.
+	varPattern = regexp.MustCompile(`\$\{[A-Za-z0-9_.-]+\}`)
+	varName    = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// parseVar parses the arguments of a var directive, NAME VALUE.
+func parseVar(args []string) (string, string, error) {
+	if len(args) != 2 {
+		return "", "", errors.New("var needs a name and a value")
+	}
+	if !varName.MatchString(args[0]) {
+		return "", "", errors.New("invalid variable name " + args[0])
+	}
+	return args[0], args[1], nil
+}
+
+// expandVars replaces the ${name} variables of line with their values, the names of undefined
+// variables are returned and their variables are kept as is.
+func (o *options) expandVars(line []byte) ([]byte, []string) {
+	if bytes.IndexByte(line, '$') < 0 {
+		return line, nil
+	}
+	var undefined []string
+	line = varPattern.ReplaceAllFunc(line, func(v []byte) []byte {
+		name := string(v[2 : len(v)-1])
+		value, ok := o.vars[name]
+		if !ok {
+			undefined = append(undefined, name)
+			return v
+		}
+		return []byte(value)
+	})
+	return line, undefined
+}
+
+// varsString returns the variables sorted by name.
+func (o *options) varsString() string {
+	names := make([]string, 0, len(o.vars))
+	for name := range o.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + o.vars[name]
+	}
+	return strings.Join(names, ",")
+}
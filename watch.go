@@ -0,0 +1,68 @@
+package etcdhosts
+
+import (
+	"sync"
+	"time"
+)
+
+// changeFeedBuffer is the number of change events buffered per watcher, events are dropped for
+// watchers that fall further behind.
+const changeFeedBuffer = 256
+
+// changeEvent is a single record change of a reload as streamed by the admin api watch.
+type changeEvent struct {
+	Time        time.Time `json:"time"`
+	Key         string    `json:"key"`
+	OldRevision int64     `json:"old_revision"`
+	Revision    int64     `json:"revision"`
+	recordChange
+}
+
+// changeFeed fans the record changes of every reload out to the watchers, the zero value has no
+// watchers.
+type changeFeed struct {
+	sync.Mutex
+	watchers map[chan changeEvent]struct{}
+}
+
+// subscribe returns a channel the change events of the following reloads are sent to.
+func (f *changeFeed) subscribe() chan changeEvent {
+	f.Lock()
+	defer f.Unlock()
+	if f.watchers == nil {
+		f.watchers = make(map[chan changeEvent]struct{})
+	}
+	ch := make(chan changeEvent, changeFeedBuffer)
+	f.watchers[ch] = struct{}{}
+	return ch
+}
+
+func (f *changeFeed) unsubscribe(ch chan changeEvent) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.watchers, ch)
+}
+
+// watched reports whether anyone watches the changes.
+func (f *changeFeed) watched() bool {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.watchers) > 0
+}
+
+// publish sends the events to every watcher without blocking the reload.
+func (f *changeFeed) publish(events []changeEvent) {
+	f.Lock()
+	defer f.Unlock()
+watchers:
+	for ch := range f.watchers {
+		for i, e := range events {
+			select {
+			case ch <- e:
+			default:
+				log.Warningf("admin watch is too slow, dropped %d change events", len(events)-i)
+				continue watchers
+			}
+		}
+	}
+}
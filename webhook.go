@@ -0,0 +1,101 @@
+package etcdhosts
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// webhookRetries is the number of attempts made for every webhook url
+	webhookRetries = 3
+	// webhookTimeout is the timeout of a single webhook request
+	webhookTimeout = 5 * time.Second
+	// webhookSignatureHeader carries the hex encoded HMAC-SHA256 of the request body
+	webhookSignatureHeader = "X-Etcdhosts-Signature"
+)
+
+// webhook posts a summary of every hosts data change to the configured urls.
+type webhook struct {
+	urls   []string
+	secret []byte
+	client *http.Client
+}
+
+// webhookPayload is the JSON body sent to webhook urls after a reload.
+type webhookPayload struct {
+	Key         string `json:"key"`
+	OldRevision int64  `json:"old_revision"`
+	Revision    int64  `json:"revision"`
+	Added       int    `json:"added"`
+	Removed     int    `json:"removed"`
+	Changed     int    `json:"changed"`
+}
+
+func newWebhook(urls []string, secret string) *webhook {
+	return &webhook{
+		urls:   urls,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// notify sends payload to every webhook url in the background.
+func (wh *webhook) notify(payload webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("failed to encode webhook payload: %s", err)
+		return
+	}
+
+	for _, u := range wh.urls {
+		go func(u string) {
+			if err := wh.post(u, body); err != nil {
+				log.Errorf("failed to notify webhook [%s]: %s", u, err)
+			}
+		}(u)
+	}
+}
+
+// post sends body to url, retrying with a linear backoff on failures.
+func (wh *webhook) post(url string, body []byte) error {
+	var err error
+	for i := 0; i < webhookRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		if err = wh.postOnce(url, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (wh *webhook) postOnce(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		mac := hmac.New(sha256.New, wh.secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}